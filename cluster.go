@@ -0,0 +1,242 @@
+package serfer
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+)
+
+// DefaultEventBuffer is the size of the event channel a Cluster passes to Serf.
+// Serf blocks its internal processing while the channel is full, so it should
+// be large enough to absorb bursts of membership changes.
+const DefaultEventBuffer = 2048
+
+var (
+	// ErrNoSeeds is returned when a Cluster is asked to join without seed addresses.
+	ErrNoSeeds = errors.New("serfer: no seeds to join")
+
+	// ErrClusterShutdown is returned when a Cluster is shut down while joining.
+	ErrClusterShutdown = errors.New("serfer: cluster is shut down")
+)
+
+// ClusterConfig is used to configure a Cluster.
+type ClusterConfig struct {
+
+	// SerfConfig configures the Serf instance. The Cluster uses a copy whose
+	// EventCh is replaced. If nil, serf.DefaultConfig is used.
+	SerfConfig *serf.Config
+
+	// Config configures the Serfer dispatching the events. If nil,
+	// DefaultConfig is used.
+	Config *Config
+
+	// EventBuffer is the size of the Serf event channel. A value less than 1
+	// uses DefaultEventBuffer.
+	EventBuffer int
+
+	// Seeds are the addresses of existing members joined when the Cluster starts.
+	Seeds []string
+
+	// IgnoreOld ignores the user events sent before joining.
+	IgnoreOld bool
+
+	// JoinAttempts is the number of times joining the seeds is attempted
+	// before Start fails. A value less than 1 makes a single attempt.
+	JoinAttempts int
+
+	// JoinInterval is the delay between join attempts.
+	JoinInterval time.Duration
+
+	// DrainTimeout is how long Shutdown waits for buffered events to be
+	// handled after leaving the cluster.
+	DrainTimeout time.Duration
+}
+
+// DefaultClusterConfig returns a ClusterConfig using the default Serf and
+// Serfer configurations, which retries joining its seeds five times a second
+// apart and drains events for up to five seconds on shutdown.
+func DefaultClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		SerfConfig:   serf.DefaultConfig(),
+		Config:       DefaultConfig(),
+		EventBuffer:  DefaultEventBuffer,
+		JoinAttempts: 5,
+		JoinInterval: time.Second,
+		DrainTimeout: 5 * time.Second,
+	}
+}
+
+// Cluster owns a Serf instance and the Serfer dispatching its events. It
+// joins the seed members when started and on shutdown leaves the cluster
+// gracefully before event dispatch stops, so handlers see the leave.
+type Cluster struct {
+	conf   ClusterConfig
+	serf   *serf.Serf
+	serfer Serfer
+	events chan serf.Event
+
+	mu           sync.Mutex
+	started      bool
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+	abandoned    int
+	shutdownErr  error
+}
+
+// NewCluster creates a Serf instance whose events are dispatched to the given
+// handler. Events are not dispatched until the Cluster is started. The
+// configuration is copied and can be reused.
+func NewCluster(handler EventHandler, conf *ClusterConfig) (*Cluster, error) {
+	if conf == nil {
+		return nil, errors.New("serfer: nil ClusterConfig")
+	}
+
+	c := &Cluster{conf: *conf, shutdownCh: make(chan struct{})}
+	if c.conf.SerfConfig == nil {
+		c.conf.SerfConfig = serf.DefaultConfig()
+	} else {
+		// Serf modifies its configuration, including the memberlist one
+		sc := *c.conf.SerfConfig
+		if sc.MemberlistConfig != nil {
+			mc := *sc.MemberlistConfig
+			sc.MemberlistConfig = &mc
+		}
+		c.conf.SerfConfig = &sc
+	}
+	if c.conf.Config == nil {
+		c.conf.Config = DefaultConfig()
+	} else if c.conf.Config.Logger == nil {
+		sc := *c.conf.Config
+		sc.Logger = log.New("serfer")
+		c.conf.Config = &sc
+	}
+	if c.conf.EventBuffer < 1 {
+		c.conf.EventBuffer = DefaultEventBuffer
+	}
+	if c.conf.JoinAttempts < 1 {
+		c.conf.JoinAttempts = 1
+	}
+
+	events := make(chan serf.Event, c.conf.EventBuffer)
+	c.conf.SerfConfig.EventCh = events
+
+	s, err := serf.Create(c.conf.SerfConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.serf = s
+	c.events = events
+	c.serfer = NewSerferConfig(events, handler, c.conf.Config)
+	return c, nil
+}
+
+// Start starts dispatching events and joins the seed members, if any. If the
+// seeds cannot be joined, the Cluster is shut down and the error is returned.
+// A Cluster which was shut down cannot be started.
+func (c *Cluster) Start() error {
+	c.mu.Lock()
+	select {
+	case <-c.shutdownCh:
+		c.mu.Unlock()
+		return ErrClusterShutdown
+	default:
+	}
+	c.started = true
+	c.serfer.Start()
+	c.mu.Unlock()
+
+	if len(c.conf.Seeds) == 0 {
+		return nil
+	}
+
+	if _, err := c.Join(c.conf.Seeds); err != nil {
+		c.Shutdown()
+		return err
+	}
+	return nil
+}
+
+// Join joins the members at the given addresses, retrying up to
+// ClusterConfig.JoinAttempts times until at least one of them is contacted.
+// It returns the number of members contacted. Retrying stops with
+// ErrClusterShutdown when the Cluster is shut down.
+func (c *Cluster) Join(addrs []string) (int, error) {
+	if len(addrs) == 0 {
+		return 0, ErrNoSeeds
+	}
+
+	logger := c.conf.Config.Logger
+	var n int
+	var err error
+	for attempt := 1; attempt <= c.conf.JoinAttempts; attempt++ {
+		select {
+		case <-c.shutdownCh:
+			return 0, ErrClusterShutdown
+		default:
+		}
+
+		n, err = c.serf.Join(addrs, c.conf.IgnoreOld)
+		if n > 0 {
+			if err != nil {
+				logger.Warn("serfer: failed to join some seeds", "joined", n, "err", err)
+			}
+			return n, nil
+		}
+
+		logger.Warn("serfer: failed to join cluster", "attempt", attempt, "err", err)
+		if attempt < c.conf.JoinAttempts {
+			timer := time.NewTimer(c.conf.JoinInterval)
+			select {
+			case <-timer.C:
+			case <-c.shutdownCh:
+				timer.Stop()
+				return 0, ErrClusterShutdown
+			}
+		}
+	}
+	return 0, err
+}
+
+// Shutdown gracefully leaves the cluster, shuts Serf down and then stops the
+// Serfer once the buffered events are handled or ClusterConfig.DrainTimeout
+// expires. It returns the number of abandoned events, including those left in
+// the Serf event channel or all of them if the Cluster was never started. A
+// Join in progress stops retrying. Calling Shutdown
+// more than once returns the result of the first call.
+func (c *Cluster) Shutdown() (int, error) {
+	c.shutdownOnce.Do(func() {
+		c.mu.Lock()
+		close(c.shutdownCh)
+		started := c.started
+		c.mu.Unlock()
+
+		logger := c.conf.Config.Logger
+		if err := c.serf.Leave(); err != nil {
+			logger.Warn("serfer: failed to leave cluster", "err", err)
+		}
+		if err := c.serf.Shutdown(); err != nil {
+			logger.Warn("serfer: failed to shut down serf", "err", err)
+		}
+
+		// The events of a Cluster which was never started are not handled
+		if !started {
+			c.abandoned = len(c.events)
+			return
+		}
+		c.abandoned, c.shutdownErr = c.serfer.StopWithTimeout(c.conf.DrainTimeout)
+	})
+	return c.abandoned, c.shutdownErr
+}
+
+// Serf returns the underlying Serf instance.
+func (c *Cluster) Serf() *serf.Serf {
+	return c.serf
+}
+
+// Serfer returns the Serfer dispatching the events of the cluster.
+func (c *Cluster) Serfer() Serfer {
+	return c.serfer
+}
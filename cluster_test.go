@@ -0,0 +1,165 @@
+package serfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// freePort returns a loopback port which is free for both TCP and UDP.
+func freePort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		l.Close()
+		if err == nil {
+			u.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+func testClusterConfig(t *testing.T, name string) *ClusterConfig {
+	conf := DefaultClusterConfig()
+	conf.SerfConfig.NodeName = name
+	conf.SerfConfig.LogOutput = ioutil.Discard
+	conf.SerfConfig.MemberlistConfig.LogOutput = ioutil.Discard
+	conf.SerfConfig.MemberlistConfig.BindAddr = "127.0.0.1"
+	conf.SerfConfig.MemberlistConfig.BindPort = freePort(t)
+	conf.SerfConfig.MemberlistConfig.GossipInterval = 5 * time.Millisecond
+	conf.SerfConfig.MemberlistConfig.ProbeInterval = 50 * time.Millisecond
+	conf.SerfConfig.MemberlistConfig.ProbeTimeout = 25 * time.Millisecond
+	conf.Config.Logger = &log.NullLogger{}
+	conf.JoinInterval = 10 * time.Millisecond
+	return conf
+}
+
+func TestCluster_Lifecycle(t *testing.T) {
+	seedHandler := &recordingHandler{}
+	seedConf := testClusterConfig(t, "a")
+	seed, err := NewCluster(seedHandler, seedConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Shutdown()
+	assert.Nil(t, seed.Start())
+
+	conf := testClusterConfig(t, "b")
+	conf.Seeds = []string{fmt.Sprintf("127.0.0.1:%d", seedConf.SerfConfig.MemberlistConfig.BindPort)}
+	c, err := NewCluster(&recordingHandler{}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, c.Start())
+	assert.Len(t, c.Serf().Members(), 2)
+
+	waitFor(t, func() bool {
+		return contains(seedHandler.recorded(), "b:member-join")
+	})
+
+	// The seed sees the graceful leave rather than a failure
+	n, err := c.Shutdown()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, serf.SerfShutdown, c.Serf().State())
+	waitFor(t, func() bool {
+		return contains(seedHandler.recorded(), "b:member-leave")
+	})
+
+	// Shutdown is idempotent
+	n, err = c.Shutdown()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestCluster_JoinFails(t *testing.T) {
+	conf := testClusterConfig(t, "a")
+	conf.Seeds = []string{fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+	conf.JoinAttempts = 2
+	c, err := NewCluster(&recordingHandler{}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, c.Start())
+	assert.Equal(t, serf.SerfShutdown, c.Serf().State())
+
+	_, err = c.Join(nil)
+	assert.Equal(t, ErrNoSeeds, err)
+}
+
+func TestCluster_Config(t *testing.T) {
+	c, err := NewCluster(&recordingHandler{}, nil)
+	assert.NotNil(t, err)
+	assert.Nil(t, c)
+
+	conf := testClusterConfig(t, "a")
+	c, err = NewCluster(&recordingHandler{}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, conf.SerfConfig.EventCh, "the caller's configuration is not modified")
+	assert.Nil(t, conf.SerfConfig.MemberlistConfig.Delegate)
+
+	// A Cluster can be shut down before it is started, but not started again
+	_, err = c.Shutdown()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrClusterShutdown, c.Start())
+
+	// A Serfer configuration without a logger gets the default one
+	conf = testClusterConfig(t, "b")
+	conf.Config = &Config{Workers: 1}
+	conf.Seeds = []string{fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+	c, err = NewCluster(&recordingHandler{}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, c.Start())
+	assert.Nil(t, conf.Config.Logger, "the caller's configuration is not modified")
+}
+
+func TestCluster_ShutdownStopsJoin(t *testing.T) {
+	conf := testClusterConfig(t, "a")
+	conf.JoinAttempts = 100
+	conf.JoinInterval = time.Hour
+	c, err := NewCluster(&recordingHandler{}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joined := make(chan error, 1)
+	go func() {
+		_, err := c.Join([]string{fmt.Sprintf("127.0.0.1:%d", freePort(t))})
+		joined <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	c.Shutdown()
+	select {
+	case err := <-joined:
+		assert.Equal(t, ErrClusterShutdown, err)
+	case <-time.After(time.Second):
+		t.Fatal("Join did not stop on shutdown")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package serfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrUnknownPayload is returned when no type is bound to an event or
+	// query name. Handlers failing with it are not retried.
+	ErrUnknownPayload error = permanentError{errors.New("serfer: no payload type bound to name")}
+
+	// ErrDuplicateBinding is returned when a name is bound twice.
+	ErrDuplicateBinding = errors.New("serfer: duplicate payload binding")
+)
+
+// Codec encodes and decodes payloads.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(b []byte, v interface{}) error
+}
+
+var (
+	// MsgpackCodec encodes payloads with msgpack, like serf does internally.
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// JSONCodec encodes payloads with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+
+	// RawCodec passes []byte and string payloads through unchanged.
+	RawCodec Codec = rawCodec{}
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	var handle codec.MsgpackHandle
+	err := codec.NewEncoder(&buf, &handle).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Decode(b []byte, v interface{}) error {
+	var handle codec.MsgpackHandle
+	return codec.NewDecoder(bytes.NewReader(b), &handle).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Encode(v interface{}) ([]byte, error) {
+	switch p := v.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		return []byte(p), nil
+	default:
+		return nil, fmt.Errorf("serfer: raw codec cannot encode %T", v)
+	}
+}
+
+func (rawCodec) Decode(b []byte, v interface{}) error {
+	switch p := v.(type) {
+	case *[]byte:
+		*p = append([]byte(nil), b...)
+	case *string:
+		*p = string(b)
+	default:
+		return fmt.Errorf("serfer: raw codec cannot decode into %T", v)
+	}
+	return nil
+}
+
+// DecodeError describes a payload which could not be decoded.
+type DecodeError struct {
+
+	// Name is the name of the user event or query.
+	Name string
+
+	// Payload is the payload which failed to decode.
+	Payload []byte
+
+	// Err is the error returned by the codec.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("serfer: failed to decode payload of %s: %v", e.Name, e.Err)
+}
+
+// Permanent returns true since decoding the same payload again cannot
+// succeed, so handlers failing with a DecodeError are not retried.
+func (e *DecodeError) Permanent() bool {
+	return true
+}
+
+// DecodeErrorHandler is called when a payload cannot be decoded.
+type DecodeErrorHandler interface {
+	HandleDecodeError(*DecodeError)
+}
+
+// binding is the type and codec of the payloads of a name.
+type binding struct {
+	typ   reflect.Type
+	codec Codec
+}
+
+// CodecRegistry binds user event and query names to payload types and codecs.
+type CodecRegistry struct {
+	mu       sync.RWMutex
+	bindings map[string]binding
+}
+
+// NewCodecRegistry returns an empty CodecRegistry.
+func NewCodecRegistry() *CodecRegistry {
+	return &CodecRegistry{bindings: make(map[string]binding)}
+}
+
+// Register binds a name to the type of prototype, such as DeployEvent{}, and
+// a codec. Payloads of the name are decoded into values of that type.
+func (r *CodecRegistry) Register(name string, prototype interface{}, c Codec) error {
+	if prototype == nil {
+		return fmt.Errorf("serfer: nil payload type for %s", name)
+	}
+	if c == nil {
+		return fmt.Errorf("serfer: nil codec for %s", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.bindings[name]; ok {
+		return ErrDuplicateBinding
+	}
+	r.bindings[name] = binding{reflect.TypeOf(prototype), c}
+	return nil
+}
+
+// Encode encodes a payload for a name. The value must have the bound type.
+func (r *CodecRegistry) Encode(name string, v interface{}) ([]byte, error) {
+	b, err := r.binding(name)
+	if err != nil {
+		return nil, err
+	}
+	if t := reflect.TypeOf(v); t != b.typ {
+		return nil, fmt.Errorf("serfer: %s payloads are %v, not %v", name, b.typ, t)
+	}
+	return b.codec.Encode(v)
+}
+
+// Decode decodes the payload of a name into a value of the bound type.
+func (r *CodecRegistry) Decode(name string, payload []byte) (interface{}, error) {
+	b, err := r.binding(name)
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.New(b.typ)
+	if err := b.codec.Decode(payload, v.Interface()); err != nil {
+		return nil, &DecodeError{Name: name, Payload: payload, Err: err}
+	}
+	return v.Elem().Interface(), nil
+}
+
+// binding returns the binding of a name.
+func (r *CodecRegistry) binding(name string) (binding, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, ok := r.bindings[name]
+	if !ok {
+		return binding{}, ErrUnknownPayload
+	}
+	return b, nil
+}
+
+// decodeFailed reports a decode error to the handler if there is one and
+// returns the error to return from the adapter.
+func decodeFailed(h DecodeErrorHandler, err error) error {
+	derr, ok := err.(*DecodeError)
+	if !ok || h == nil {
+		return err
+	}
+	h.HandleDecodeError(derr)
+	return nil
+}
+
+// TypedUserEventHandler is a UserEventHandler which decodes the payload of
+// user events with a CodecRegistry before calling Handler with the decoded
+// value. Payloads which fail to decode are reported to OnError instead; if it
+// is nil the *DecodeError is returned.
+type TypedUserEventHandler struct {
+	Codecs  *CodecRegistry
+	Handler func(ctx context.Context, e serf.UserEvent, payload interface{}) error
+	OnError DecodeErrorHandler
+}
+
+// HandleUserEvent decodes and handles a user event.
+func (t TypedUserEventHandler) HandleUserEvent(e serf.UserEvent) {
+	t.HandleUserEventErr(context.Background(), e)
+}
+
+// HandleUserEventErr decodes and handles a user event with a context.
+func (t TypedUserEventHandler) HandleUserEventErr(ctx context.Context, e serf.UserEvent) error {
+	v, err := t.Codecs.Decode(e.Name, e.Payload)
+	if err != nil {
+		return decodeFailed(t.OnError, err)
+	}
+	return t.Handler(ctx, e, v)
+}
+
+// TypedQueryHandler is a QueryHandler which decodes the payload of queries
+// with a CodecRegistry before calling Handler with the decoded value. The
+// value returned by Handler is encoded with the codec bound to the query name.
+// Payloads which fail to decode are reported to OnError, if it is set, and
+// answered with the *DecodeError.
+type TypedQueryHandler struct {
+	Codecs  *CodecRegistry
+	Handler func(ctx context.Context, q *serf.Query, payload interface{}) (interface{}, error)
+	OnError DecodeErrorHandler
+}
+
+// ServeQuery decodes and answers a query.
+func (t TypedQueryHandler) ServeQuery(ctx context.Context, q *serf.Query) ([]byte, error) {
+	v, err := t.Codecs.Decode(q.Name, q.Payload)
+	if err != nil {
+		if derr, ok := err.(*DecodeError); ok && t.OnError != nil {
+			t.OnError.HandleDecodeError(derr)
+		}
+		return nil, err
+	}
+
+	resp, err := t.Handler(ctx, q, v)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	b, err := t.Codecs.binding(q.Name)
+	if err != nil {
+		return nil, err
+	}
+	return b.codec.Encode(resp)
+}
@@ -0,0 +1,152 @@
+package serfer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type deployEvent struct {
+	Service string
+	Version int
+}
+
+// decodeErrors records decode errors.
+type decodeErrors []*DecodeError
+
+func (d *decodeErrors) HandleDecodeError(err *DecodeError) {
+	*d = append(*d, err)
+}
+
+func TestCodecRegistry_RoundTrip(t *testing.T) {
+	r := NewCodecRegistry()
+	assert.Nil(t, r.Register("deploy", deployEvent{}, MsgpackCodec))
+	assert.Nil(t, r.Register("deploy-json", deployEvent{}, JSONCodec))
+	assert.Nil(t, r.Register("ping", []byte{}, RawCodec))
+	assert.Nil(t, r.Register("echo", "", RawCodec))
+	assert.Equal(t, ErrDuplicateBinding, r.Register("deploy", deployEvent{}, JSONCodec))
+	assert.EqualError(t, r.Register("nil", deployEvent{}, nil), "serfer: nil codec for nil")
+
+	for _, name := range []string{"deploy", "deploy-json"} {
+		b, err := r.Encode(name, deployEvent{"web", 3})
+		assert.Nil(t, err)
+		v, err := r.Decode(name, b)
+		assert.Nil(t, err)
+		assert.Equal(t, deployEvent{"web", 3}, v)
+	}
+
+	b, err := r.Encode("ping", []byte("raw"))
+	assert.Nil(t, err)
+	v, err := r.Decode("ping", b)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("raw"), v)
+	v, err = r.Decode("echo", []byte("text"))
+	assert.Nil(t, err)
+	assert.Equal(t, "text", v)
+
+	_, err = r.Encode("deploy", &deployEvent{})
+	assert.NotNil(t, err, "values must have the bound type")
+	_, err = r.Encode("unknown", nil)
+	assert.Equal(t, ErrUnknownPayload, err)
+
+	_, err = r.Decode("deploy-json", []byte("{"))
+	if assert.IsType(t, &DecodeError{}, err) {
+		assert.Equal(t, "deploy-json", err.(*DecodeError).Name)
+	}
+}
+
+func TestTypedUserEventHandler(t *testing.T) {
+	r := NewCodecRegistry()
+	r.Register("deploy", deployEvent{}, JSONCodec)
+	payload, _ := r.Encode("deploy", deployEvent{"web", 3})
+
+	var handled []deployEvent
+	h := TypedUserEventHandler{
+		Codecs: r,
+		Handler: func(ctx context.Context, e serf.UserEvent, v interface{}) error {
+			handled = append(handled, v.(deployEvent))
+			return nil
+		},
+	}
+
+	assert.Nil(t, h.HandleUserEventErr(context.Background(), serf.UserEvent{Name: "deploy", Payload: payload}))
+	assert.Equal(t, []deployEvent{{"web", 3}}, handled)
+
+	// Decode errors are returned unless there is an error handler
+	bad := serf.UserEvent{Name: "deploy", Payload: []byte("not json")}
+	assert.IsType(t, &DecodeError{}, h.HandleUserEventErr(context.Background(), bad))
+
+	var errs decodeErrors
+	h.OnError = &errs
+	assert.Nil(t, h.HandleUserEventErr(context.Background(), bad))
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, []byte("not json"), errs[0].Payload)
+	}
+	assert.Equal(t, ErrUnknownPayload, h.HandleUserEventErr(context.Background(), serf.UserEvent{Name: "other"}))
+	assert.Len(t, handled, 1)
+}
+
+func TestTypedUserEventHandler_NotRetried(t *testing.T) {
+	r := NewCodecRegistry()
+	r.Register("deploy", deployEvent{}, JSONCodec)
+	f := &failures{}
+	h := SerfEventHandler{
+		ServicePrefix: "svc",
+		UserEvent: TypedUserEventHandler{
+			Codecs: r,
+			Handler: func(ctx context.Context, e serf.UserEvent, v interface{}) error {
+				return nil
+			},
+		},
+		Retry:          &RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, Multiplier: 1},
+		FailureHandler: f,
+		Logger:         &log.NullLogger{},
+	}
+
+	// Neither would succeed on retry, so the backoff is never waited for
+	assert.IsType(t, &DecodeError{}, h.HandleEventErr(context.Background(), userEvent("svc:deploy", 1, false)))
+	assert.Equal(t, ErrUnknownPayload, h.HandleEventErr(context.Background(), userEvent("svc:other", 1, false)))
+	if assert.Len(t, *f, 2) {
+		assert.Equal(t, 1, (*f)[0].Attempts)
+		assert.Equal(t, 1, (*f)[1].Attempts)
+	}
+}
+
+func TestTypedQueryHandler(t *testing.T) {
+	r := NewCodecRegistry()
+	r.Register("version", deployEvent{}, MsgpackCodec)
+
+	var responses [][]byte
+	now := time.Now()
+	m := testQueryMux(&responses, now.Add(time.Second), now)
+	var errs decodeErrors
+	m.Handle("version", TypedQueryHandler{
+		Codecs: r,
+		Handler: func(ctx context.Context, q *serf.Query, v interface{}) (interface{}, error) {
+			d := v.(deployEvent)
+			d.Version++
+			return d, nil
+		},
+		OnError: &errs,
+	})
+
+	payload, _ := r.Encode("version", deployEvent{"web", 3})
+	assert.Nil(t, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "version", Payload: payload}))
+	assert.Nil(t, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "version", Payload: []byte{0xc1}}))
+
+	if assert.Len(t, responses, 2) {
+		b, err := DecodeQueryResponse(responses[0])
+		assert.Nil(t, err)
+		v, err := r.Decode("version", b)
+		assert.Nil(t, err)
+		assert.Equal(t, deployEvent{"web", 4}, v)
+
+		_, err = DecodeQueryResponse(responses[1])
+		assert.IsType(t, &QueryError{}, err)
+	}
+	assert.Len(t, errs, 1)
+}
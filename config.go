@@ -0,0 +1,63 @@
+package serfer
+
+import (
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+)
+
+// Config is used to configure a Serfer.
+type Config struct {
+
+	// Workers is the number of goroutines handling events. Events about the
+	// same member are always handled by the same worker.
+	Workers int
+
+	// QueueSize is the maximum number of events buffered between the source
+	// channel and the workers.
+	QueueSize int
+
+	// PauseQueueSize is the maximum number of events buffered while the Serfer
+	// is paused. It is raised to QueueSize if smaller.
+	PauseQueueSize int
+
+	// OverflowPolicy determines what happens when the queue is full.
+	OverflowPolicy OverflowPolicy
+
+	// SheddableTypes are the event types dropped by the OverflowDropByType policy.
+	SheddableTypes []serf.EventType
+
+	// OverflowHandler is notified when events are dropped. It is optional.
+	OverflowHandler OverflowHandler
+
+	// PanicPolicy determines what happens when an event handler panics.
+	PanicPolicy PanicPolicy
+
+	// DeadLetterHandler receives events whose handler panicked. It is optional.
+	DeadLetterHandler DeadLetterHandler
+
+	// Journal records events before they are dispatched. Events which were not
+	// handled when the Serfer stopped are replayed when it starts again. It is
+	// optional.
+	Journal Journal
+
+	// MetricsPrefix is the prefix of the keys of the emitted metrics. If it is
+	// nil, DefaultMetricsPrefix is used.
+	MetricsPrefix []string
+
+	// Logs output
+	Logger log.Logger
+}
+
+// DefaultConfig returns a Config with a single worker that blocks when the
+// queue is full and continues after a handler panics.
+func DefaultConfig() *Config {
+	return &Config{
+		Workers:        1,
+		QueueSize:      1024,
+		PauseQueueSize: 8192,
+		OverflowPolicy: OverflowBlock,
+		SheddableTypes: []serf.EventType{serf.EventUser},
+		PanicPolicy:    PanicContinue,
+		Logger:         log.New("serfer"),
+	}
+}
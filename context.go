@@ -0,0 +1,107 @@
+package serfer
+
+import (
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// contextKey is used to store serfer values in handler contexts.
+type contextKey int
+
+const (
+	receivedKey contextKey = iota
+	sourceKey
+	replayedKey
+	statsKey
+	paramsKey
+	batchKey
+	retrierKey
+	originKey
+	schedulerKey
+)
+
+// ReceivedAt returns the time the Serfer read the event being handled from
+// its event channel.
+func ReceivedAt(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(receivedKey).(time.Time)
+	return t, ok
+}
+
+// withReceived returns a context carrying the time an event was received.
+func withReceived(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, receivedKey, t)
+}
+
+// SourceFromContext returns the name of the source the event being handled
+// was read from.
+func SourceFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(sourceKey).(string)
+	return name, ok
+}
+
+// withSource returns a context carrying the name of an event source.
+func withSource(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, sourceKey, name)
+}
+
+// Replayed returns true if the event being handled was replayed from the
+// journal after a restart.
+func Replayed(ctx context.Context) bool {
+	replayed, _ := ctx.Value(replayedKey).(bool)
+	return replayed
+}
+
+// withReplayed returns a context marking the event as replayed.
+func withReplayed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayedKey, true)
+}
+
+// originFromContext returns the event read by the Serfer which the event being
+// handled was split from, or nil.
+func originFromContext(ctx context.Context) serf.Event {
+	e, _ := ctx.Value(originKey).(serf.Event)
+	return e
+}
+
+// withOrigin returns a context carrying the event an event was split from.
+func withOrigin(ctx context.Context, e serf.Event) context.Context {
+	return context.WithValue(ctx, originKey, e)
+}
+
+// retrierFromContext returns the retrier of the handler being called, if any.
+func retrierFromContext(ctx context.Context) *retrier {
+	r, _ := ctx.Value(retrierKey).(*retrier)
+	return r
+}
+
+// withRetrier returns a context carrying the retrier used by fan-outs. A nil
+// retrier stops nested fan-outs from retrying their handlers again.
+func withRetrier(ctx context.Context, r *retrier) context.Context {
+	return context.WithValue(ctx, retrierKey, r)
+}
+
+// scheduler runs tasks on the workers of the Serfer handling an event.
+type scheduler interface {
+
+	// schedule queues a task for the worker which handles the events of the
+	// member of e, after the events already queued. It returns false if the
+	// Serfer is stopping.
+	schedule(e serf.MemberEvent, task func(context.Context) error) bool
+
+	// stopped is closed once the Serfer stops.
+	stopped() <-chan struct{}
+}
+
+// schedulerFromContext returns the scheduler of the Serfer handling the event,
+// or nil if the event is not handled by a Serfer.
+func schedulerFromContext(ctx context.Context) scheduler {
+	s, _ := ctx.Value(schedulerKey).(scheduler)
+	return s
+}
+
+// withScheduler returns a context carrying the scheduler of a Serfer.
+func withScheduler(ctx context.Context, s scheduler) context.Context {
+	return context.WithValue(ctx, schedulerKey, s)
+}
@@ -0,0 +1,270 @@
+package serfer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// FanOutMode determines how an event is delivered to multiple handlers.
+type FanOutMode int
+
+const (
+	// FanOutSequential calls the handlers one after another in order.
+	FanOutSequential FanOutMode = iota
+
+	// FanOutParallel calls every handler in its own goroutine and waits for all of them.
+	FanOutParallel
+)
+
+// MultiError aggregates the errors returned by multiple handlers.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d errors occurred:", len(m))
+	for _, err := range m {
+		fmt.Fprintf(&buf, " %v;", err)
+	}
+	return buf.String()
+}
+
+// fanOut calls fn for each of n handlers and returns a MultiError of the
+// failures, in handler order. When the fan-out is called by a handler with a
+// retry policy, each handler which fails is retried on its own. A panic in a
+// parallel handler is re-raised in the calling goroutine once every handler
+// has returned.
+func fanOut(ctx context.Context, mode FanOutMode, n int, fn func(context.Context, int) error) error {
+	call := func(i int) error { return fn(ctx, i) }
+	if r := retrierFromContext(ctx); r != nil {
+		hctx := withRetrier(ctx, nil)
+		call = func(i int) error {
+			return r.retry(hctx, func() error { return fn(hctx, i) })
+		}
+	}
+
+	errs := make([]error, n)
+	if mode == FanOutParallel && n > 1 {
+		var wg sync.WaitGroup
+		panics := make([]interface{}, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() {
+					panics[i] = recover()
+				}()
+				errs[i] = call(i)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, p := range panics {
+			if p != nil {
+				panic(p)
+			}
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			errs[i] = call(i)
+		}
+	}
+
+	var merr MultiError
+	for _, err := range errs {
+		if err != nil {
+			merr = append(merr, err)
+		}
+	}
+	if len(merr) == 0 {
+		return nil
+	}
+	return merr
+}
+
+// MemberJoinHandlers delivers member join events to multiple handlers.
+type MemberJoinHandlers struct {
+	Mode     FanOutMode
+	Handlers []MemberJoinHandler
+}
+
+// HandleMemberJoin calls every handler with the event.
+func (h MemberJoinHandlers) HandleMemberJoin(e serf.MemberEvent) {
+	h.HandleMemberJoinErr(context.Background(), e)
+}
+
+// HandleMemberJoinErr calls every handler with the event and aggregates their errors.
+func (h MemberJoinHandlers) HandleMemberJoinErr(ctx context.Context, e serf.MemberEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleMemberJoin(ctx, h.Handlers[i], e)
+	})
+}
+
+// MemberUpdateHandlers delivers member update events to multiple handlers.
+type MemberUpdateHandlers struct {
+	Mode     FanOutMode
+	Handlers []MemberUpdateHandler
+}
+
+// HandleMemberUpdate calls every handler with the event.
+func (h MemberUpdateHandlers) HandleMemberUpdate(e serf.MemberEvent) {
+	h.HandleMemberUpdateErr(context.Background(), e)
+}
+
+// HandleMemberUpdateErr calls every handler with the event and aggregates their errors.
+func (h MemberUpdateHandlers) HandleMemberUpdateErr(ctx context.Context, e serf.MemberEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleMemberUpdate(ctx, h.Handlers[i], e)
+	})
+}
+
+// MemberLeaveHandlers delivers member leave events to multiple handlers.
+type MemberLeaveHandlers struct {
+	Mode     FanOutMode
+	Handlers []MemberLeaveHandler
+}
+
+// HandleMemberLeave calls every handler with the event.
+func (h MemberLeaveHandlers) HandleMemberLeave(e serf.MemberEvent) {
+	h.HandleMemberLeaveErr(context.Background(), e)
+}
+
+// HandleMemberLeaveErr calls every handler with the event and aggregates their errors.
+func (h MemberLeaveHandlers) HandleMemberLeaveErr(ctx context.Context, e serf.MemberEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleMemberLeave(ctx, h.Handlers[i], e)
+	})
+}
+
+// MemberFailureHandlers delivers member failure events to multiple handlers.
+type MemberFailureHandlers struct {
+	Mode     FanOutMode
+	Handlers []MemberFailureHandler
+}
+
+// HandleMemberFailure calls every handler with the event.
+func (h MemberFailureHandlers) HandleMemberFailure(e serf.MemberEvent) {
+	h.HandleMemberFailureErr(context.Background(), e)
+}
+
+// HandleMemberFailureErr calls every handler with the event and aggregates their errors.
+func (h MemberFailureHandlers) HandleMemberFailureErr(ctx context.Context, e serf.MemberEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleMemberFailure(ctx, h.Handlers[i], e)
+	})
+}
+
+// MemberReapHandlers delivers member reap events to multiple handlers.
+type MemberReapHandlers struct {
+	Mode     FanOutMode
+	Handlers []MemberReapHandler
+}
+
+// HandleMemberReap calls every handler with the event.
+func (h MemberReapHandlers) HandleMemberReap(e serf.MemberEvent) {
+	h.HandleMemberReapErr(context.Background(), e)
+}
+
+// HandleMemberReapErr calls every handler with the event and aggregates their errors.
+func (h MemberReapHandlers) HandleMemberReapErr(ctx context.Context, e serf.MemberEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleMemberReap(ctx, h.Handlers[i], e)
+	})
+}
+
+// UserEventHandlers delivers user events to multiple handlers.
+type UserEventHandlers struct {
+	Mode     FanOutMode
+	Handlers []UserEventHandler
+}
+
+// HandleUserEvent calls every handler with the event.
+func (h UserEventHandlers) HandleUserEvent(e serf.UserEvent) {
+	h.HandleUserEventErr(context.Background(), e)
+}
+
+// HandleUserEventErr calls every handler with the event and aggregates their errors.
+func (h UserEventHandlers) HandleUserEventErr(ctx context.Context, e serf.UserEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleUserEvent(ctx, h.Handlers[i], e)
+	})
+}
+
+// UnknownEventHandlers delivers unknown events to multiple handlers.
+type UnknownEventHandlers struct {
+	Mode     FanOutMode
+	Handlers []UnknownEventHandler
+}
+
+// HandleUnknownEvent calls every handler with the event.
+func (h UnknownEventHandlers) HandleUnknownEvent(e serf.UserEvent) {
+	h.HandleUnknownEventErr(context.Background(), e)
+}
+
+// HandleUnknownEventErr calls every handler with the event and aggregates their errors.
+func (h UnknownEventHandlers) HandleUnknownEventErr(ctx context.Context, e serf.UserEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleUnknownEvent(ctx, h.Handlers[i], e)
+	})
+}
+
+// LeaderElectionHandlers delivers leader election events to multiple handlers.
+type LeaderElectionHandlers struct {
+	Mode     FanOutMode
+	Handlers []LeaderElectionHandler
+}
+
+// HandleLeaderElection calls every handler with the event.
+func (h LeaderElectionHandlers) HandleLeaderElection(e serf.UserEvent) {
+	h.HandleLeaderElectionErr(context.Background(), e)
+}
+
+// HandleLeaderElectionErr calls every handler with the event and aggregates their errors.
+func (h LeaderElectionHandlers) HandleLeaderElectionErr(ctx context.Context, e serf.UserEvent) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleLeaderElection(ctx, h.Handlers[i], e)
+	})
+}
+
+// QueryEventHandlers delivers query events to multiple handlers.
+type QueryEventHandlers struct {
+	Mode     FanOutMode
+	Handlers []QueryEventHandler
+}
+
+// HandleQueryEvent calls every handler with the query.
+func (h QueryEventHandlers) HandleQueryEvent(q serf.Query) {
+	h.HandleQueryEventErr(context.Background(), &q)
+}
+
+// HandleQueryEventErr calls every handler with the query and aggregates their errors.
+func (h QueryEventHandlers) HandleQueryEventErr(ctx context.Context, q *serf.Query) error {
+	return fanOut(ctx, h.Mode, len(h.Handlers), func(ctx context.Context, i int) error {
+		return handleQueryEvent(ctx, h.Handlers[i], q)
+	})
+}
+
+// Reconcilers delivers members to multiple Reconcilers.
+type Reconcilers struct {
+	Mode        FanOutMode
+	Reconcilers []Reconciler
+}
+
+// Reconcile calls every Reconciler with the member.
+func (r Reconcilers) Reconcile(m serf.Member) {
+	r.ReconcileErr(context.Background(), m)
+}
+
+// ReconcileErr calls every Reconciler with the member and aggregates their errors.
+func (r Reconcilers) ReconcileErr(ctx context.Context, m serf.Member) error {
+	return fanOut(ctx, r.Mode, len(r.Reconcilers), func(ctx context.Context, i int) error {
+		return reconcileMember(ctx, r.Reconcilers[i], m)
+	})
+}
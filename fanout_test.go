@@ -0,0 +1,98 @@
+package serfer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// joinRecorder records the order in which join handlers are called.
+type joinRecorder struct {
+	sync.Mutex
+	name  string
+	order *[]string
+}
+
+func (j *joinRecorder) HandleMemberJoin(e serf.MemberEvent) {
+	j.Lock()
+	*j.order = append(*j.order, j.name)
+	j.Unlock()
+}
+
+// failingJoin fails every join event.
+type failingJoin struct {
+	err error
+}
+
+func (f failingJoin) HandleMemberJoin(e serf.MemberEvent) {}
+
+func (f failingJoin) HandleMemberJoinErr(ctx context.Context, e serf.MemberEvent) error {
+	return f.err
+}
+
+func TestFanOut_Sequential(t *testing.T) {
+	var order []string
+	h := MemberJoinHandlers{Handlers: []MemberJoinHandler{
+		&joinRecorder{name: "metrics", order: &order},
+		&joinRecorder{name: "cache", order: &order},
+		&joinRecorder{name: "routes", order: &order},
+	}}
+
+	h.HandleMemberJoin(memberEvent(serf.EventMemberJoin, "a"))
+	assert.Equal(t, []string{"metrics", "cache", "routes"}, order)
+}
+
+func TestFanOut_ParallelAggregatesErrors(t *testing.T) {
+	var order []string
+	first, second := errors.New("first"), errors.New("second")
+	h := MemberJoinHandlers{
+		Mode: FanOutParallel,
+		Handlers: []MemberJoinHandler{
+			failingJoin{first},
+			&joinRecorder{name: "cache", order: &order},
+			failingJoin{second},
+		},
+	}
+
+	err := h.HandleMemberJoinErr(context.Background(), memberEvent(serf.EventMemberJoin, "a"))
+	assert.Equal(t, MultiError{first, second}, err)
+	assert.EqualError(t, err, "2 errors occurred: first; second;")
+	assert.Equal(t, []string{"cache"}, order)
+}
+
+func TestFanOut_ParallelPanic(t *testing.T) {
+	h := Reconcilers{
+		Mode: FanOutParallel,
+		Reconcilers: []Reconciler{
+			&MockEventHandler{},
+			&MockEventHandler{},
+		},
+	}
+
+	// The mocks panic because no calls were expected
+	assert.Panics(t, func() {
+		h.Reconcile(serf.Member{Name: "a"})
+	})
+}
+
+func (suite *EventHandlerTestSuite) TestFanOut() {
+	var order []string
+	suite.Handler.NodeJoined = MemberJoinHandlers{Handlers: []MemberJoinHandler{
+		suite.Mocker,
+		&joinRecorder{name: "cache", order: &order},
+	}}
+
+	evt := serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{suite.Member},
+	}
+	suite.Mocker.On("HandleMemberJoin", evt).Return()
+	suite.Mocker.On("Reconcile", suite.Member).Return()
+	suite.Handler.HandleEvent(evt)
+	suite.Mocker.AssertCalled(suite.T(), "HandleMemberJoin", evt)
+	suite.Equal([]string{"cache"}, order)
+}
@@ -0,0 +1,345 @@
+package serfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultFlapWindow is the window used when FlapDetector.Window is zero.
+	DefaultFlapWindow = 2 * time.Minute
+
+	// DefaultFlapThreshold is the threshold used when FlapDetector.Threshold is zero.
+	DefaultFlapThreshold = 4
+
+	// DefaultStablePeriod is the period used when FlapDetector.StablePeriod is zero.
+	DefaultStablePeriod = 5 * time.Minute
+)
+
+// Flap describes a member which started flapping.
+type Flap struct {
+
+	// Member is the flapping member.
+	Member serf.Member
+
+	// Transitions is the number of transitions of the member in the window.
+	Transitions int
+
+	// Time is when the member was marked flapping.
+	Time time.Time
+}
+
+// FlapHandler is notified when a member starts flapping.
+type FlapHandler interface {
+	HandleFlapping(Flap)
+}
+
+// FlapErrHandler is notified when a member starts flapping and reports failure.
+type FlapErrHandler interface {
+	HandleFlappingErr(context.Context, Flap) error
+}
+
+// StableHandler is notified when a flapping member is stable again.
+type StableHandler interface {
+	HandleStable(serf.MemberEvent)
+}
+
+// StableErrHandler is notified when a flapping member is stable again and
+// reports failure.
+type StableErrHandler interface {
+	HandleStableErr(context.Context, serf.MemberEvent) error
+}
+
+// flapState is the recent history of a member.
+type flapState struct {
+	transitions []time.Time
+	flapping    bool
+
+	// last is the last event of the member, reported once it is stable.
+	last serf.MemberEvent
+
+	// timer fires when a flapping member may be stable.
+	timer *time.Timer
+
+	// sched is the scheduler of the Serfer which handled the last event, if
+	// any.
+	sched scheduler
+}
+
+// FlapDetector counts the join, leave and failure events of every member over
+// a sliding window. A member with Threshold or more events in the Window is
+// flapping until it has had no event for the StablePeriod, at which point its
+// last event is passed to the Stable handler. Members are forgotten when they
+// are reaped. The zero value uses the defaults and is safe for concurrent use.
+type FlapDetector struct {
+
+	// Window is the duration over which transitions are counted.
+	Window time.Duration
+
+	// Threshold is the number of transitions in the window which marks a
+	// member as flapping.
+	Threshold int
+
+	// StablePeriod is how long a flapping member must go without a
+	// transition before it is considered stable again.
+	StablePeriod time.Duration
+
+	// Handler is notified when a member starts flapping.
+	Handler FlapHandler
+
+	// Stable is notified with the last event of a flapping member once it
+	// has been stable for the StablePeriod, even if no other event follows,
+	// so that its final state can be reconciled. If the last event was handled
+	// by a Serfer, it is called by the worker of the member after the events
+	// already queued, and not at all once the Serfer stops. Otherwise it is
+	// called from its own goroutine.
+	Stable StableHandler
+
+	mu      sync.Mutex
+	members map[string]*flapState
+	now     func() time.Time
+
+	// followed are the Serfers whose stop cancels the timers they armed.
+	followed map[<-chan struct{}]bool
+}
+
+// Flapping returns true if a member is flapping.
+func (d *FlapDetector) Flapping(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st, ok := d.members[name]
+	return ok && d.flapping(st, d.clock())
+}
+
+// Observe records the transitions of the members of an event and returns the
+// members which started flapping because of it.
+func (d *FlapDetector) Observe(e serf.MemberEvent) []Flap {
+	return d.observe(e, nil)
+}
+
+// observe records the transitions of the members of an event handled by the
+// Serfer of sched, if it is not nil.
+func (d *FlapDetector) observe(e serf.MemberEvent, sched scheduler) []Flap {
+	switch e.Type {
+	case serf.EventMemberJoin, serf.EventMemberLeave, serf.EventMemberFailed, serf.EventMemberReap:
+	default:
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.members == nil {
+		d.members = make(map[string]*flapState)
+	}
+
+	now := d.clock()
+	var flaps []Flap
+	for _, m := range e.Members {
+		st, ok := d.members[m.Name]
+		if e.Type == serf.EventMemberReap {
+			if ok && st.timer != nil {
+				st.timer.Stop()
+			}
+			delete(d.members, m.Name)
+			continue
+		}
+
+		if !ok {
+			st = &flapState{}
+			d.members[m.Name] = st
+		}
+
+		// A member which has been stable is handled by this event
+		flapping := d.flapping(st, now)
+		if st.flapping && !flapping {
+			d.settle(st)
+		}
+
+		// Drop the transitions which left the window
+		cutoff := now.Add(-d.window())
+		i := 0
+		for i < len(st.transitions) && !st.transitions[i].After(cutoff) {
+			i++
+		}
+		st.transitions = append(st.transitions[i:], now)
+		st.last = serf.MemberEvent{Type: e.Type, Members: []serf.Member{m}}
+		st.sched = sched
+
+		if !flapping && len(st.transitions) >= d.threshold() {
+			st.flapping = true
+			flaps = append(flaps, Flap{Member: m, Transitions: len(st.transitions), Time: now})
+		}
+		if st.flapping {
+			d.watch(m.Name, st)
+			if sched != nil {
+				d.follow(sched)
+			}
+		}
+	}
+	return flaps
+}
+
+// flapping returns true if the member is flapping and has not been stable for
+// the stable period.
+func (d *FlapDetector) flapping(st *flapState, now time.Time) bool {
+	return st.flapping && now.Sub(st.transitions[len(st.transitions)-1]) < d.stablePeriod()
+}
+
+// settle clears the state of a member which is stable again.
+func (d *FlapDetector) settle(st *flapState) {
+	st.flapping = false
+	st.transitions = nil
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
+
+// watch arms the timer which reports a flapping member once it is stable.
+func (d *FlapDetector) watch(name string, st *flapState) {
+	if st.timer != nil {
+		st.timer.Reset(d.stablePeriod())
+		return
+	}
+	st.timer = time.AfterFunc(d.stablePeriod(), func() {
+		d.fire(name, st)
+	})
+}
+
+// follow stops the timers armed for the events handled by the Serfer of sched
+// once it stops. It must be called with the lock held.
+func (d *FlapDetector) follow(sched scheduler) {
+	stopped := sched.stopped()
+	if d.followed[stopped] {
+		return
+	}
+	if d.followed == nil {
+		d.followed = make(map[<-chan struct{}]bool)
+	}
+	d.followed[stopped] = true
+
+	go func() {
+		<-stopped
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.followed, stopped)
+		for _, st := range d.members {
+			if st.sched != nil && st.sched.stopped() == stopped && st.timer != nil {
+				st.timer.Stop()
+				st.timer = nil
+			}
+		}
+	}()
+}
+
+// fire reports a member whose timer fired. If its last event was handled by a
+// Serfer, the report is queued for the worker of the member so that it is
+// ordered with the events of the member.
+func (d *FlapDetector) fire(name string, st *flapState) {
+	d.mu.Lock()
+	sched, e := st.sched, st.last
+	d.mu.Unlock()
+
+	if sched == nil {
+		d.stable(context.Background(), name, st)
+		return
+	}
+	sched.schedule(e, func(ctx context.Context) error {
+		return d.stable(ctx, name, st)
+	})
+}
+
+// stable notifies the Stable handler of a member whose timer fired, unless
+// it flapped again, was reaped or was already handled by another event.
+func (d *FlapDetector) stable(ctx context.Context, name string, st *flapState) error {
+	d.mu.Lock()
+	if d.members[name] != st || !st.flapping || d.flapping(st, d.clock()) {
+		d.mu.Unlock()
+		return nil
+	}
+	d.settle(st)
+	e := st.last
+	d.mu.Unlock()
+
+	if d.Stable == nil {
+		return nil
+	}
+	return handleStable(ctx, d.Stable, e)
+}
+
+// clock returns the current time.
+func (d *FlapDetector) clock() time.Time {
+	if d.now == nil {
+		return time.Now()
+	}
+	return d.now()
+}
+
+// window returns the window or its default.
+func (d *FlapDetector) window() time.Duration {
+	if d.Window <= 0 {
+		return DefaultFlapWindow
+	}
+	return d.Window
+}
+
+// threshold returns the threshold or its default.
+func (d *FlapDetector) threshold() int {
+	if d.Threshold <= 0 {
+		return DefaultFlapThreshold
+	}
+	return d.Threshold
+}
+
+// stablePeriod returns the stable period or its default.
+func (d *FlapDetector) stablePeriod() time.Duration {
+	if d.StablePeriod <= 0 {
+		return DefaultStablePeriod
+	}
+	return d.StablePeriod
+}
+
+// flaps notifies the handler of the Flaps detector of members which started flapping.
+func (s *SerfEventHandler) flaps(ctx context.Context, e serf.MemberEvent, flaps []Flap) error {
+	h := s.Flaps.Handler
+	if h == nil {
+		return nil
+	}
+
+	var err error
+	for _, f := range flaps {
+		f := f
+		s.Logger.Warn("serfer: member is flapping", "member", f.Member.Name, "transitions", f.Transitions)
+		ferr := s.try(ctx, KindFlap, serf.MemberEvent{Type: e.Type, Members: []serf.Member{f.Member}}, func(ctx context.Context) error {
+			return handleFlapping(ctx, h, f)
+		})
+		if err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// handleStable calls the error variant of a StableHandler if it implements it.
+func handleStable(ctx context.Context, h StableHandler, e serf.MemberEvent) error {
+	if c, ok := h.(StableErrHandler); ok {
+		return c.HandleStableErr(ctx, e)
+	}
+	h.HandleStable(e)
+	return nil
+}
+
+// handleFlapping calls the error variant of a FlapHandler if it implements it.
+func handleFlapping(ctx context.Context, h FlapHandler, f Flap) error {
+	if c, ok := h.(FlapErrHandler); ok {
+		return c.HandleFlappingErr(ctx, f)
+	}
+	h.HandleFlapping(f)
+	return nil
+}
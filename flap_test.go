@@ -0,0 +1,248 @@
+package serfer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// flapRecorder records the members which started flapping.
+type flapRecorder []Flap
+
+func (f *flapRecorder) HandleFlapping(flap Flap) {
+	*f = append(*f, flap)
+}
+
+// stableRecorder records the events of members which are stable again.
+type stableRecorder struct {
+	sync.Mutex
+	events []serf.MemberEvent
+}
+
+func (r *stableRecorder) HandleStable(e serf.MemberEvent) {
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+}
+
+func (r *stableRecorder) recorded() []serf.MemberEvent {
+	r.Lock()
+	defer r.Unlock()
+	return append([]serf.MemberEvent(nil), r.events...)
+}
+
+// memberReconciler records the members it reconciles.
+type memberReconciler struct {
+	sync.Mutex
+	members []serf.Member
+}
+
+func (r *memberReconciler) Reconcile(m serf.Member) {
+	r.Lock()
+	r.members = append(r.members, m)
+	r.Unlock()
+}
+
+func (r *memberReconciler) reconciled() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.members)
+}
+
+// testFlapDetector returns a FlapDetector whose clock is controlled by the
+// returned function.
+func testFlapDetector() (*FlapDetector, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	d := &FlapDetector{Window: time.Minute, Threshold: 3, StablePeriod: 5 * time.Minute}
+	d.now = func() time.Time { return now }
+	return d, func(dt time.Duration) { now = now.Add(dt) }
+}
+
+func TestFlapDetector(t *testing.T) {
+	d, advance := testFlapDetector()
+
+	assert.Len(t, d.Observe(memberEvent(serf.EventMemberJoin, "a", "b")), 0)
+	advance(40 * time.Second)
+	assert.Len(t, d.Observe(memberEvent(serf.EventMemberFailed, "a")), 0)
+	advance(30 * time.Second)
+	assert.Len(t, d.Observe(memberEvent(serf.EventMemberJoin, "a")), 0, "the first join left the window")
+	assert.False(t, d.Flapping("a"))
+
+	advance(10 * time.Second)
+	flaps := d.Observe(memberEvent(serf.EventMemberFailed, "a"))
+	if assert.Len(t, flaps, 1) {
+		assert.Equal(t, "a", flaps[0].Member.Name)
+		assert.Equal(t, 3, flaps[0].Transitions)
+	}
+	assert.True(t, d.Flapping("a"))
+	assert.False(t, d.Flapping("b"))
+	assert.Len(t, d.Observe(memberEvent(serf.EventMemberJoin, "a")), 0, "flapping is only reported once")
+
+	advance(4 * time.Minute)
+	assert.True(t, d.Flapping("a"))
+	advance(time.Minute)
+	assert.False(t, d.Flapping("a"), "a is stable again")
+	assert.Len(t, d.Observe(memberEvent(serf.EventMemberFailed, "a")), 0)
+
+	d.Observe(memberEvent(serf.EventMemberJoin, "a"))
+	d.Observe(memberEvent(serf.EventMemberFailed, "a"))
+	assert.True(t, d.Flapping("a"))
+	d.Observe(memberEvent(serf.EventMemberReap, "a"))
+	assert.False(t, d.Flapping("a"), "reaped members are forgotten")
+}
+
+func TestSerfEventHandler_SuppressesFlappingReconciles(t *testing.T) {
+	var flaps flapRecorder
+	detector, advance := testFlapDetector()
+	detector.Handler = &flaps
+	rec := &flakyReconciler{}
+	h := SerfEventHandler{
+		IsLeader:        func() bool { return true },
+		ReconcileOnJoin: true,
+		ReconcileOnFail: true,
+		Reconciler:      rec,
+		Flaps:           detector,
+		Logger:          &log.NullLogger{},
+	}
+
+	for _, e := range []serf.MemberEvent{
+		memberEvent(serf.EventMemberJoin, "a", "b"),
+		memberEvent(serf.EventMemberFailed, "a"),
+		memberEvent(serf.EventMemberJoin, "a"),
+		memberEvent(serf.EventMemberFailed, "a", "b"),
+	} {
+		assert.Nil(t, h.HandleEventErr(context.Background(), e))
+	}
+	assert.Len(t, flaps, 1)
+	assert.Equal(t, 4, rec.calls, "a is not reconciled once it is flapping")
+
+	advance(5 * time.Minute)
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a"))
+	assert.Equal(t, 5, rec.calls)
+}
+
+func TestFlapDetector_Stable(t *testing.T) {
+	stable := &stableRecorder{}
+	d := &FlapDetector{Window: time.Minute, Threshold: 3, StablePeriod: 20 * time.Millisecond, Stable: stable}
+
+	d.Observe(memberEvent(serf.EventMemberJoin, "a", "b", "c"))
+	d.Observe(memberEvent(serf.EventMemberFailed, "a", "c"))
+	d.Observe(memberEvent(serf.EventMemberJoin, "a", "c"))
+	assert.True(t, d.Flapping("a"))
+	d.Observe(memberEvent(serf.EventMemberReap, "c"))
+
+	// No further event is needed to report a once it is stable
+	waitFor(t, func() bool {
+		return len(stable.recorded()) > 0
+	})
+	assert.False(t, d.Flapping("a"))
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, []serf.MemberEvent{memberEvent(serf.EventMemberJoin, "a")}, stable.recorded(),
+		"only flapping members which were not reaped are reported")
+}
+
+func TestNewSerfEventHandler_ReconcilesStableMembers(t *testing.T) {
+	rec := &memberReconciler{}
+	h, err := NewSerfEventHandler(
+		WithLeader(func() bool { return true }),
+		WithHandler(KindReconcile, rec),
+		WithReconcileOn(serf.EventMemberJoin, serf.EventMemberFailed),
+		WithFlapDetector(&FlapDetector{Window: time.Minute, Threshold: 3, StablePeriod: 20 * time.Millisecond}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a"))
+	h.HandleEvent(memberEvent(serf.EventMemberFailed, "a"))
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a"))
+	h.HandleEvent(memberEvent(serf.EventMemberFailed, "a"))
+	assert.Equal(t, 2, rec.reconciled(), "a is not reconciled while it is flapping")
+
+	// The final state of a is reconciled without another event
+	waitFor(t, func() bool {
+		return rec.reconciled() == 3
+	})
+}
+
+// blockingUser blocks on user events until it is released.
+type blockingUser chan struct{}
+
+func (b blockingUser) HandleUserEvent(serf.UserEvent) {
+	<-b
+}
+
+func TestSerfer_StableOrderedWithQueuedEvents(t *testing.T) {
+	rec := &memberReconciler{}
+	block := make(blockingUser)
+	h, err := NewSerfEventHandler(
+		WithLeader(func() bool { return true }),
+		WithHandler(KindReconcile, rec),
+		WithServicePrefix("svc"),
+		WithHandler(KindUserEvent, block),
+		WithReconcileOn(serf.EventMemberJoin, serf.EventMemberFailed),
+		WithFlapDetector(&FlapDetector{Window: time.Minute, Threshold: 2, StablePeriod: 20 * time.Millisecond}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ch := make(chan serf.Event, 4)
+	s := NewSerfer(ch, h, 1)
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	ch <- memberEvent(serf.EventMemberFailed, "a")
+	ch <- userEvent("svc:block", 1, false)
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+
+	// a is stable while its last join waits behind the blocked worker
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 1, rec.reconciled(), "a is not reconciled outside of its worker")
+	close(block)
+
+	// The queued join supersedes the failure the detector last observed
+	waitFor(t, func() bool {
+		return rec.reconciled() == 2
+	})
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, 2, rec.reconciled())
+	assert.Nil(t, s.Stop())
+}
+
+func TestSerfer_NoStableAfterStop(t *testing.T) {
+	rec := &memberReconciler{}
+	d := &FlapDetector{Window: time.Minute, Threshold: 2, StablePeriod: 20 * time.Millisecond}
+	h, err := NewSerfEventHandler(
+		WithLeader(func() bool { return true }),
+		WithHandler(KindReconcile, rec),
+		WithReconcileOn(serf.EventMemberJoin, serf.EventMemberFailed),
+		WithFlapDetector(d),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ch := make(chan serf.Event, 2)
+	s := NewSerfer(ch, h, 1)
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	ch <- memberEvent(serf.EventMemberFailed, "a")
+	waitFor(t, func() bool {
+		return d.Flapping("a")
+	})
+	assert.Nil(t, s.Stop())
+
+	// The timer of a is stopped with the Serfer
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.members["a"].timer == nil
+	})
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, 1, rec.reconciled())
+}
@@ -2,9 +2,12 @@ package serfer
 
 import (
 	"strings"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/serf/serf"
 	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -74,15 +77,160 @@ type Reconciler interface {
 	Reconcile(serf.Member)
 }
 
+// ContextEventHandler processes generic Serf events with a context. The Serfer
+// prefers it over EventHandler when a handler implements both.
+type ContextEventHandler interface {
+	HandleEventContext(context.Context, serf.Event)
+}
+
+// MemberEventContextHandler handles membership change events with a context.
+type MemberEventContextHandler interface {
+	HandleMemberEventContext(context.Context, serf.MemberEvent)
+}
+
+// MemberJoinContextHandler handles member join events with a context.
+type MemberJoinContextHandler interface {
+	HandleMemberJoinContext(context.Context, serf.MemberEvent)
+}
+
+// MemberUpdateContextHandler handles member update events with a context.
+type MemberUpdateContextHandler interface {
+	HandleMemberUpdateContext(context.Context, serf.MemberEvent)
+}
+
+// MemberLeaveContextHandler handles member leave events with a context.
+type MemberLeaveContextHandler interface {
+	HandleMemberLeaveContext(context.Context, serf.MemberEvent)
+}
+
+// MemberFailureContextHandler handles member failure events with a context.
+type MemberFailureContextHandler interface {
+	HandleMemberFailureContext(context.Context, serf.MemberEvent)
+}
+
+// MemberReapContextHandler handles member reap events with a context.
+type MemberReapContextHandler interface {
+	HandleMemberReapContext(context.Context, serf.MemberEvent)
+}
+
+// UserEventContextHandler handles user events with a context.
+type UserEventContextHandler interface {
+	HandleUserEventContext(context.Context, serf.UserEvent)
+}
+
+// UnknownEventContextHandler handles unknown events with a context.
+type UnknownEventContextHandler interface {
+	HandleUnknownEventContext(context.Context, serf.UserEvent)
+}
+
+// QueryEventContextHandler handles Serf query events with a context. The
+// context expires at the query deadline.
+type QueryEventContextHandler interface {
+	HandleQueryEventContext(context.Context, *serf.Query)
+}
+
+// LeaderElectionContextHandler handles leader election events with a context.
+type LeaderElectionContextHandler interface {
+	HandleLeaderElectionContext(context.Context, serf.UserEvent)
+}
+
+// ContextReconciler reconciles Serf events with an external process using a context.
+// The context is cancelled when the Serfer stops.
+type ContextReconciler interface {
+	ReconcileContext(context.Context, serf.Member)
+}
+
+// ErrEventHandler processes generic Serf events and reports failure. The Serfer
+// prefers it over ContextEventHandler and EventHandler.
+type ErrEventHandler interface {
+	HandleEventErr(context.Context, serf.Event) error
+}
+
+// MemberEventErrHandler handles membership change events and reports failure.
+type MemberEventErrHandler interface {
+	HandleMemberEventErr(context.Context, serf.MemberEvent) error
+}
+
+// MemberJoinErrHandler handles member join events and reports failure.
+type MemberJoinErrHandler interface {
+	HandleMemberJoinErr(context.Context, serf.MemberEvent) error
+}
+
+// MemberUpdateErrHandler handles member update events and reports failure.
+type MemberUpdateErrHandler interface {
+	HandleMemberUpdateErr(context.Context, serf.MemberEvent) error
+}
+
+// MemberLeaveErrHandler handles member leave events and reports failure.
+type MemberLeaveErrHandler interface {
+	HandleMemberLeaveErr(context.Context, serf.MemberEvent) error
+}
+
+// MemberFailureErrHandler handles member failure events and reports failure.
+type MemberFailureErrHandler interface {
+	HandleMemberFailureErr(context.Context, serf.MemberEvent) error
+}
+
+// MemberReapErrHandler handles member reap events and reports failure.
+type MemberReapErrHandler interface {
+	HandleMemberReapErr(context.Context, serf.MemberEvent) error
+}
+
+// UserEventErrHandler handles user events and reports failure.
+type UserEventErrHandler interface {
+	HandleUserEventErr(context.Context, serf.UserEvent) error
+}
+
+// UnknownEventErrHandler handles unknown events and reports failure.
+type UnknownEventErrHandler interface {
+	HandleUnknownEventErr(context.Context, serf.UserEvent) error
+}
+
+// QueryEventErrHandler handles Serf query events and reports failure. The
+// context expires at the query deadline.
+type QueryEventErrHandler interface {
+	HandleQueryEventErr(context.Context, *serf.Query) error
+}
+
+// LeaderElectionErrHandler handles leader election events and reports failure.
+type LeaderElectionErrHandler interface {
+	HandleLeaderElectionErr(context.Context, serf.UserEvent) error
+}
+
+// ErrReconciler reconciles Serf events with an external process and reports failure.
+type ErrReconciler interface {
+	ReconcileErr(context.Context, serf.Member) error
+}
+
 // IsLeaderFunc should return true if the local node is the cluster leader.
 type IsLeaderFunc func() bool
 
 // SerfEventHandler is used to dispatch various Serf events to separate event handlers.
+//
+// Handlers which also implement the context variant of their interface, such as
+// MemberJoinContextHandler, are called with the event context instead. Handlers
+// implementing the error variant, such as MemberJoinErrHandler, are preferred over
+// both and are retried according to the Retry policy when they fail.
+//
+// Several handlers can subscribe to the same event kind with the fan-out types,
+// such as MemberJoinHandlers. Only the handlers of a fan-out which failed are
+// retried; those which succeeded are not called again.
+//
+// Handlers which process one member at a time, such as MemberJoinedHandler,
+// can be used for member events by wrapping them in a MemberSplitter.
 type SerfEventHandler struct {
 
 	// ServicePrefix is used to filter out unknown events.
 	ServicePrefix string
 
+	// Separator separates the service prefix from the event name. If it is
+	// empty, ":" is used.
+	Separator string
+
+	// Namespaces are additional services sharing the cluster, each with its own
+	// prefix and handlers. They are matched before ServicePrefix.
+	Namespaces []Namespace
+
 	// ReconcileOnJoin determines if the Reconiler is called when a node joins the cluster.
 	ReconcileOnJoin bool
 
@@ -98,7 +246,8 @@ type SerfEventHandler struct {
 	// ReconcileOnReap determines if the Reconiler is called when a node is reaped from the cluster.
 	ReconcileOnReap bool
 
-	// IsLeader determines if the local node is the cluster leader.
+	// IsLeader determines if the local node is the cluster leader. If it is
+	// nil, the local node is never the leader.
 	IsLeader IsLeaderFunc
 
 	// IsLeaderEventFunc determines if an event is a leader election event based on the event name.
@@ -128,12 +277,51 @@ type SerfEventHandler struct {
 	// Called when a Member has been updated.
 	NodeUpdated MemberUpdateHandler
 
+	// Statuses tracks the last known status of every member. Transition
+	// handlers are only called when it is set.
+	Statuses *StatusTracker
+
+	// Called when the status of a Member changes, after the member event handler.
+	NodeTransitioned TransitionHandler
+
+	// Called when a failed Member is alive again. NodeJoined is called as well.
+	NodeRecovered TransitionHandler
+
+	// Called when a Member which left is alive again. NodeJoined is called as well.
+	NodeRejoined TransitionHandler
+
+	// Tags tracks the tags of every member and reports their changes to its
+	// handlers, after the member event handler.
+	Tags *TagTracker
+
+	// Flaps detects members oscillating between statuses. Flapping members
+	// are not reconciled until they are stable again. Set the Stable handler
+	// of the detector to the SerfEventHandler to reconcile their last event
+	// then; NewSerfEventHandler does so unless it is already set.
+	Flaps *FlapDetector
+
 	// Called when a membership event occurs.
 	Reconciler Reconciler
 
 	// Called when a serf.Query is received.
 	QueryHandler QueryEventHandler
 
+	// Retry determines how failed handlers are retried. Failed handlers are
+	// not retried if it is nil.
+	Retry *RetryPolicy
+
+	// Called when a handler has failed and will not be retried.
+	FailureHandler FailureHandler
+
+	// MetricsPrefix is the prefix of the keys of the emitted metrics. If it is
+	// nil, DefaultMetricsPrefix is used.
+	MetricsPrefix []string
+
+	// UserEventMetrics adds the names of user events to the keys of their
+	// metrics. Event names are chosen by whoever sends the events, so it
+	// should only be set when the services send a known set of events.
+	UserEventMetrics bool
+
 	// Logs output
 	Logger log.Logger
 }
@@ -141,11 +329,43 @@ type SerfEventHandler struct {
 // HandleEvent processes a generic Serf event and dispatches it to the appropriate
 // destination.
 func (s SerfEventHandler) HandleEvent(e serf.Event) {
+	s.HandleEventContext(context.Background(), e)
+}
+
+// HandleEventContext processes a generic Serf event and dispatches it to the appropriate
+// destination with the given context.
+func (s SerfEventHandler) HandleEventContext(ctx context.Context, e serf.Event) {
+	s.HandleEventErr(ctx, e)
+}
+
+// HandleEventErr processes a generic Serf event and dispatches it to the appropriate
+// destination with the given context. It returns the first error of a handler which
+// failed after exhausting its retries.
+func (s SerfEventHandler) HandleEventErr(ctx context.Context, e serf.Event) error {
 	if e == nil {
-		return
+		return nil
 	}
 
+	start := time.Now()
+	var err error
 	var reconcile bool
+
+	// Track the members before dispatching the event
+	var transitions []Transition
+	var diffs []TagDiff
+	var flaps []Flap
+	if me, ok := e.(serf.MemberEvent); ok {
+		if s.Statuses != nil {
+			transitions = s.Statuses.Observe(me)
+		}
+		if s.Tags != nil {
+			diffs = s.Tags.Observe(me)
+		}
+		if s.Flaps != nil {
+			flaps = s.Flaps.observe(me, schedulerFromContext(ctx))
+		}
+	}
+
 	switch e.EventType() {
 
 	// If the event is a Join event, call NodeJoined and then reconcile event with
@@ -153,7 +373,9 @@ func (s SerfEventHandler) HandleEvent(e serf.Event) {
 	case serf.EventMemberJoin:
 		reconcile = s.ReconcileOnJoin
 		if s.NodeJoined != nil {
-			s.NodeJoined.HandleMemberJoin(e.(serf.MemberEvent))
+			err = s.try(ctx, KindMemberJoin, e, func(ctx context.Context) error {
+				return handleMemberJoin(ctx, s.NodeJoined, e.(serf.MemberEvent))
+			})
 		}
 
 	// If the event is a Leave event, call NodeLeft and then reconcile event with
@@ -161,7 +383,9 @@ func (s SerfEventHandler) HandleEvent(e serf.Event) {
 	case serf.EventMemberLeave:
 		reconcile = s.ReconcileOnLeave
 		if s.NodeLeft != nil {
-			s.NodeLeft.HandleMemberLeave(e.(serf.MemberEvent))
+			err = s.try(ctx, KindMemberLeave, e, func(ctx context.Context) error {
+				return handleMemberLeave(ctx, s.NodeLeft, e.(serf.MemberEvent))
+			})
 		}
 
 	// If the event is a Failed event, call NodeFailed and then reconcile event with
@@ -169,57 +393,106 @@ func (s SerfEventHandler) HandleEvent(e serf.Event) {
 	case serf.EventMemberFailed:
 		reconcile = s.ReconcileOnFail
 		if s.NodeFailed != nil {
-			s.NodeFailed.HandleMemberFailure(e.(serf.MemberEvent))
+			err = s.try(ctx, KindMemberFailed, e, func(ctx context.Context) error {
+				return handleMemberFailure(ctx, s.NodeFailed, e.(serf.MemberEvent))
+			})
 		}
 
 	// If the event is a Reap event, reconcile event with persistent storage.
 	case serf.EventMemberReap:
 		reconcile = s.ReconcileOnReap
 		if s.NodeReaped != nil {
-			s.NodeReaped.HandleMemberReap(e.(serf.MemberEvent))
+			err = s.try(ctx, KindMemberReap, e, func(ctx context.Context) error {
+				return handleMemberReap(ctx, s.NodeReaped, e.(serf.MemberEvent))
+			})
 		}
 
 	// If the event is a user event, handle leader elections, user events and unknown events.
 	case serf.EventUser:
-		s.handleUserEvent(e.(serf.UserEvent))
+		err = s.handleUserEvent(ctx, e.(serf.UserEvent))
 
 	// If the event is an Update event, call NodeUpdated
 	case serf.EventMemberUpdate:
 		reconcile = s.ReconcileOnUpdate
 		if s.NodeUpdated != nil {
-			s.NodeUpdated.HandleMemberUpdate(e.(serf.MemberEvent))
+			err = s.try(ctx, KindMemberUpdate, e, func(ctx context.Context) error {
+				return handleMemberUpdate(ctx, s.NodeUpdated, e.(serf.MemberEvent))
+			})
 		}
 
 	// If the event is a query, call Query Handler
 	case serf.EventQuery:
 		if s.QueryHandler != nil {
-			s.QueryHandler.HandleQueryEvent(*e.(*serf.Query))
+			err = s.try(ctx, KindQuery, e, func(ctx context.Context) error {
+				return handleQueryEvent(ctx, s.QueryHandler, e.(*serf.Query))
+			})
 		}
 	default:
 		s.Logger.Warn("unhandled Serf Event: %#v", e)
-		return
+		return nil
+	}
+
+	// Report status transitions
+	if len(transitions) > 0 {
+		if terr := s.transitions(ctx, e.(serf.MemberEvent), transitions); err == nil {
+			err = terr
+		}
+	}
+
+	// Report tag changes
+	if len(diffs) > 0 {
+		if terr := s.tagDiffs(ctx, e.(serf.MemberEvent), diffs); err == nil {
+			err = terr
+		}
+	}
+
+	// Report flapping members
+	if len(flaps) > 0 {
+		if ferr := s.flaps(ctx, e.(serf.MemberEvent), flaps); err == nil {
+			err = ferr
+		}
 	}
 
 	// Reconcile event with external storage
 	if reconcile && s.Reconciler != nil {
-		s.reconcile(e.(serf.MemberEvent))
+		if rerr := s.reconcile(ctx, e.(serf.MemberEvent)); err == nil {
+			err = rerr
+		}
 	}
+
+	measureEvent(s.MetricsPrefix, e, start, err)
+	return err
 }
 
 // reconcile is used to reconcile Serf events with the strongly
-// consistent store if we are the current leader
-func (s *SerfEventHandler) reconcile(me serf.MemberEvent) {
+// consistent store if we are the current leader. Reconciliation stops early
+// if the context is done. The first member which failed to reconcile is
+// reported in the returned error.
+func (s *SerfEventHandler) reconcile(ctx context.Context, me serf.MemberEvent) error {
 
 	// Do nothing if we are not the leader.
-	if !s.IsLeader() {
-		return
+	if s.IsLeader == nil || !s.IsLeader() {
+		return nil
 	}
+	defer metrics.MeasureSince(metricsKey(s.MetricsPrefix, "reconcile"), time.Now())
 
 	// Check if this is a reap event
 	isReap := me.EventType() == serf.EventMemberReap
 
 	// Queue the members for reconciliation
+	var err error
 	for _, m := range me.Members {
+		if ctx.Err() != nil {
+			return err
+		}
+
+		// Skip flapping members until they are stable
+		if s.Flaps != nil && s.Flaps.Flapping(m.Name) {
+			s.Logger.Debug("serfer: not reconciling flapping member", "member", m.Name)
+			metrics.IncrCounter(metricsKey(s.MetricsPrefix, "reconcile", "suppressed"), 1)
+			continue
+		}
+
 		// Change the status if this is a reap event
 		if isReap {
 			m.Status = StatusReap
@@ -227,24 +500,71 @@ func (s *SerfEventHandler) reconcile(me serf.MemberEvent) {
 
 		// Call reconcile
 		if s.Reconciler != nil {
-			s.Reconciler.Reconcile(m)
+			m := m
+			rerr := s.try(ctx, KindReconcile, serf.MemberEvent{Type: me.Type, Members: []serf.Member{m}}, func(ctx context.Context) error {
+				return reconcileMember(ctx, s.Reconciler, m)
+			})
+			metrics.IncrCounter(metricsKey(s.MetricsPrefix, "reconcile", outcome(rerr)), 1)
+			if err == nil {
+				err = rerr
+			}
 		}
 	}
+	return err
+}
+
+// HandleStable reconciles a member which stopped flapping with its last
+// event, if events of its type are reconciled.
+func (s SerfEventHandler) HandleStable(e serf.MemberEvent) {
+	s.HandleStableErr(context.Background(), e)
+}
+
+// HandleStableErr reconciles a member which stopped flapping with its last
+// event with the given context, if events of its type are reconciled.
+func (s SerfEventHandler) HandleStableErr(ctx context.Context, e serf.MemberEvent) error {
+	if s.Reconciler == nil || !s.reconciles(e.Type) {
+		return nil
+	}
+	return s.reconcile(ctx, e)
+}
+
+// reconciles returns true if the members of events of the given type are reconciled.
+func (s *SerfEventHandler) reconciles(t serf.EventType) bool {
+	switch t {
+	case serf.EventMemberJoin:
+		return s.ReconcileOnJoin
+	case serf.EventMemberLeave:
+		return s.ReconcileOnLeave
+	case serf.EventMemberFailed:
+		return s.ReconcileOnFail
+	case serf.EventMemberUpdate:
+		return s.ReconcileOnUpdate
+	case serf.EventMemberReap:
+		return s.ReconcileOnReap
+	}
+	return false
 }
 
 // handleUserEvent is called when a user event is received from both local and remote nodes.
-func (s *SerfEventHandler) handleUserEvent(event serf.UserEvent) {
+func (s *SerfEventHandler) handleUserEvent(ctx context.Context, event serf.UserEvent) error {
+	ns := s.namespace(event.Name)
 	switch name := event.Name; {
 
 	// Handles leader election events
-	case s.IsLeaderEvent(name):
+	case s.IsLeaderEvent != nil && s.IsLeaderEvent(name):
 		s.Logger.Info("serfer: New leader elected: %s", event.Payload)
 
 		// Process leader election event
 		if s.LeaderElectionHandler != nil {
-			s.LeaderElectionHandler.HandleLeaderElection(event)
+			return s.try(ctx, KindLeaderElection, event, func(ctx context.Context) error {
+				return handleLeaderElection(ctx, s.LeaderElectionHandler, event)
+			})
 		}
 
+	// Handle the events of other services
+	case ns != nil:
+		return s.handleNamespaceEvent(ctx, ns, event)
+
 	// Handle service events
 	case s.isServiceEvent(name):
 		event.Name = s.getRawEventName(name)
@@ -252,7 +572,11 @@ func (s *SerfEventHandler) handleUserEvent(event serf.UserEvent) {
 
 		// Process user event
 		if s.UserEvent != nil {
-			s.UserEvent.HandleUserEvent(event)
+			err := s.try(ctx, KindUserEvent, event, func(ctx context.Context) error {
+				return handleUserEvent(ctx, s.UserEvent, event)
+			})
+			metrics.IncrCounter(s.userEventKey(event.Name, outcome(err)), 1)
+			return err
 		}
 
 	// Handle unknown user events
@@ -261,17 +585,188 @@ func (s *SerfEventHandler) handleUserEvent(event serf.UserEvent) {
 
 		// Process unknown event
 		if s.UnknownEventHandler != nil {
-			s.UnknownEventHandler.HandleUnknownEvent(event)
+			return s.try(ctx, KindUnknownEvent, event, func(ctx context.Context) error {
+				return handleUnknownEvent(ctx, s.UnknownEventHandler, event)
+			})
 		}
 	}
+	return nil
+}
+
+// userEventKey returns the metrics key of the outcome of a user event. The
+// event name is only included if UserEventMetrics is set.
+func (s *SerfEventHandler) userEventKey(name, outcome string, namespace ...string) []string {
+	key := append([]string{"user"}, namespace...)
+	if s.UserEventMetrics {
+		key = append(key, name)
+	}
+	return metricsKey(s.MetricsPrefix, append(key, outcome)...)
 }
 
 // getRawEventName is used to get the raw event name
 func (s *SerfEventHandler) getRawEventName(name string) string {
-	return strings.TrimPrefix(name, s.ServicePrefix+":")
+	return strings.TrimPrefix(name, s.ServicePrefix+s.separator())
 }
 
 // isServiceEvent checks if a serf event is a known event
 func (s *SerfEventHandler) isServiceEvent(name string) bool {
-	return strings.HasPrefix(name, s.ServicePrefix+":")
+	return strings.HasPrefix(name, s.ServicePrefix+s.separator())
+}
+
+// separator returns the separator between service prefixes and event names.
+func (s *SerfEventHandler) separator() string {
+	if s.Separator == "" {
+		return ":"
+	}
+	return s.Separator
+}
+
+// handleEvent calls the error or context variant of an EventHandler if it implements one.
+func handleEvent(ctx context.Context, h EventHandler, e serf.Event) error {
+	switch c := h.(type) {
+	case ErrEventHandler:
+		return c.HandleEventErr(ctx, e)
+	case ContextEventHandler:
+		c.HandleEventContext(ctx, e)
+	default:
+		h.HandleEvent(e)
+	}
+	return nil
+}
+
+// handleMemberJoin calls the error or context variant of a MemberJoinHandler if it implements one.
+func handleMemberJoin(ctx context.Context, h MemberJoinHandler, e serf.MemberEvent) error {
+	switch c := h.(type) {
+	case MemberJoinErrHandler:
+		return c.HandleMemberJoinErr(ctx, e)
+	case MemberJoinContextHandler:
+		c.HandleMemberJoinContext(ctx, e)
+	default:
+		h.HandleMemberJoin(e)
+	}
+	return nil
+}
+
+// handleMemberUpdate calls the error or context variant of a MemberUpdateHandler if it implements one.
+func handleMemberUpdate(ctx context.Context, h MemberUpdateHandler, e serf.MemberEvent) error {
+	switch c := h.(type) {
+	case MemberUpdateErrHandler:
+		return c.HandleMemberUpdateErr(ctx, e)
+	case MemberUpdateContextHandler:
+		c.HandleMemberUpdateContext(ctx, e)
+	default:
+		h.HandleMemberUpdate(e)
+	}
+	return nil
+}
+
+// handleMemberLeave calls the error or context variant of a MemberLeaveHandler if it implements one.
+func handleMemberLeave(ctx context.Context, h MemberLeaveHandler, e serf.MemberEvent) error {
+	switch c := h.(type) {
+	case MemberLeaveErrHandler:
+		return c.HandleMemberLeaveErr(ctx, e)
+	case MemberLeaveContextHandler:
+		c.HandleMemberLeaveContext(ctx, e)
+	default:
+		h.HandleMemberLeave(e)
+	}
+	return nil
+}
+
+// handleMemberFailure calls the error or context variant of a MemberFailureHandler if it implements one.
+func handleMemberFailure(ctx context.Context, h MemberFailureHandler, e serf.MemberEvent) error {
+	switch c := h.(type) {
+	case MemberFailureErrHandler:
+		return c.HandleMemberFailureErr(ctx, e)
+	case MemberFailureContextHandler:
+		c.HandleMemberFailureContext(ctx, e)
+	default:
+		h.HandleMemberFailure(e)
+	}
+	return nil
+}
+
+// handleMemberReap calls the error or context variant of a MemberReapHandler if it implements one.
+func handleMemberReap(ctx context.Context, h MemberReapHandler, e serf.MemberEvent) error {
+	switch c := h.(type) {
+	case MemberReapErrHandler:
+		return c.HandleMemberReapErr(ctx, e)
+	case MemberReapContextHandler:
+		c.HandleMemberReapContext(ctx, e)
+	default:
+		h.HandleMemberReap(e)
+	}
+	return nil
+}
+
+// handleUserEvent calls the error or context variant of a UserEventHandler if it implements one.
+func handleUserEvent(ctx context.Context, h UserEventHandler, e serf.UserEvent) error {
+	switch c := h.(type) {
+	case UserEventErrHandler:
+		return c.HandleUserEventErr(ctx, e)
+	case UserEventContextHandler:
+		c.HandleUserEventContext(ctx, e)
+	default:
+		h.HandleUserEvent(e)
+	}
+	return nil
+}
+
+// handleUnknownEvent calls the error or context variant of an UnknownEventHandler if it implements one.
+func handleUnknownEvent(ctx context.Context, h UnknownEventHandler, e serf.UserEvent) error {
+	switch c := h.(type) {
+	case UnknownEventErrHandler:
+		return c.HandleUnknownEventErr(ctx, e)
+	case UnknownEventContextHandler:
+		c.HandleUnknownEventContext(ctx, e)
+	default:
+		h.HandleUnknownEvent(e)
+	}
+	return nil
+}
+
+// handleLeaderElection calls the error or context variant of a LeaderElectionHandler if it implements one.
+func handleLeaderElection(ctx context.Context, h LeaderElectionHandler, e serf.UserEvent) error {
+	switch c := h.(type) {
+	case LeaderElectionErrHandler:
+		return c.HandleLeaderElectionErr(ctx, e)
+	case LeaderElectionContextHandler:
+		c.HandleLeaderElectionContext(ctx, e)
+	default:
+		h.HandleLeaderElection(e)
+	}
+	return nil
+}
+
+// handleQueryEvent calls the error or context variant of a QueryEventHandler if it
+// implements one. The context passed to the handler expires at the query deadline.
+func handleQueryEvent(ctx context.Context, h QueryEventHandler, q *serf.Query) error {
+	if deadline := q.Deadline(); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	switch c := h.(type) {
+	case QueryEventErrHandler:
+		return c.HandleQueryEventErr(ctx, q)
+	case QueryEventContextHandler:
+		c.HandleQueryEventContext(ctx, q)
+	default:
+		h.HandleQueryEvent(*q)
+	}
+	return nil
+}
+
+// reconcileMember calls the error or context variant of a Reconciler if it implements one.
+func reconcileMember(ctx context.Context, r Reconciler, m serf.Member) error {
+	switch c := r.(type) {
+	case ErrReconciler:
+		return c.ReconcileErr(ctx, m)
+	case ContextReconciler:
+		c.ReconcileContext(ctx, m)
+	default:
+		r.Reconcile(m)
+	}
+	return nil
 }
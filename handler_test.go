@@ -7,6 +7,7 @@ import (
 	"github.com/hashicorp/serf/serf"
 	log "github.com/mgutz/logxi/v1"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/context"
 )
 
 // In order for 'go test' to run this suite, we need to create
@@ -287,3 +288,49 @@ func (suite *EventHandlerTestSuite) TestNonLeaderEvent() {
 	suite.True(called, "IsLeader should have been called")
 	suite.Mocker.AssertNotCalled(suite.T(), "Reconcile")
 }
+
+// contextJoinHandler implements both variants of MemberJoinHandler and Reconciler.
+type contextJoinHandler struct {
+	joined     []context.Context
+	reconciled []serf.Member
+}
+
+func (c *contextJoinHandler) HandleMemberJoin(e serf.MemberEvent) {
+	panic("HandleMemberJoinContext should be preferred")
+}
+
+func (c *contextJoinHandler) HandleMemberJoinContext(ctx context.Context, e serf.MemberEvent) {
+	c.joined = append(c.joined, ctx)
+}
+
+func (c *contextJoinHandler) Reconcile(m serf.Member) {
+	panic("ReconcileContext should be preferred")
+}
+
+func (c *contextJoinHandler) ReconcileContext(ctx context.Context, m serf.Member) {
+	c.reconciled = append(c.reconciled, m)
+}
+
+// Test context variants are preferred and cancellation stops reconciliation
+func (suite *EventHandlerTestSuite) TestContextHandlers() {
+	h := &contextJoinHandler{}
+	suite.Handler.NodeJoined = h
+	suite.Handler.Reconciler = h
+
+	evt := serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{suite.Member, suite.Member},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	suite.Handler.HandleEventContext(ctx, evt)
+	suite.Len(h.joined, 1)
+	suite.Equal(ctx.Done(), h.joined[0].Done(), "the handler is called with a context derived from ctx")
+	suite.Len(h.reconciled, 2)
+
+	// A cancelled context skips reconciliation
+	cancel()
+	suite.Handler.HandleEventContext(ctx, evt)
+	suite.Len(h.joined, 2)
+	suite.Len(h.reconciled, 2)
+}
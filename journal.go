@@ -0,0 +1,426 @@
+package serfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/serf/serf"
+)
+
+// ErrJournalClosed is returned when a closed journal is used.
+var ErrJournalClosed = errors.New("serfer: journal closed")
+
+// Journal durably records events before they are dispatched so that events
+// which were not handled when the process stopped can be replayed.
+type Journal interface {
+
+	// Append records an event and returns its sequence number. The event must
+	// be durable when Append returns.
+	Append(JournalEntry) (uint64, error)
+
+	// Ack marks the event with the given sequence number as handled.
+	Ack(seq uint64) error
+
+	// Pending returns the events which were recorded but not acknowledged
+	// when the journal was opened, in the order they were appended.
+	Pending() ([]JournalEntry, error)
+}
+
+// JournalEntry is an event recorded in a Journal.
+type JournalEntry struct {
+
+	// Seq is the sequence number assigned by the journal.
+	Seq uint64
+
+	// Source is the name of the source the event was read from.
+	Source string
+
+	// Received is when the event was read from its source.
+	Received time.Time
+
+	// Event is the recorded event. Queries are replayed with their metadata
+	// only; they cannot be responded to.
+	Event serf.Event
+}
+
+// DefaultSegmentSize is the size at which a FileJournal starts a new segment.
+const DefaultSegmentSize = 4 << 20
+
+const (
+	recordAppend byte = 1
+	recordAck    byte = 2
+
+	// recordHeaderSize is the size of a record header: the record type, the
+	// sequence number, the payload length and the payload checksum.
+	recordHeaderSize = 1 + 8 + 4 + 4
+
+	segmentExt = ".journal"
+)
+
+// FileJournal is a Journal stored in a directory of segment files. Appended
+// events and acknowledgements are written to the newest segment. A segment is
+// deleted once all of its events and those of every older segment have been
+// acknowledged.
+//
+// Appends are synced to disk before returning. Acknowledgements are not, so an
+// event may be replayed after a crash even though it was handled.
+type FileJournal struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []*segment
+	file        *os.File
+	size        int64
+	next        uint64
+	unacked     map[uint64]*segment
+	replay      []JournalEntry
+	closed      bool
+}
+
+// segment is a journal file and the number of its events not yet acknowledged.
+type segment struct {
+	path    string
+	unacked int
+}
+
+// journalRecord is the encoded form of a journaled event.
+type journalRecord struct {
+	Source   string
+	Received int64
+	Type     serf.EventType
+	Members  []serf.Member
+	Name     string
+	Payload  []byte
+	LTime    serf.LamportTime
+	Coalesce bool
+}
+
+// OpenFileJournal opens the journal stored in dir, creating the directory if
+// needed. A segmentSize less than 1 uses DefaultSegmentSize. Records left
+// incomplete by a crash are discarded.
+func OpenFileJournal(dir string, segmentSize int64) (*FileJournal, error) {
+	if segmentSize < 1 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &FileJournal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		next:        1,
+		unacked:     make(map[uint64]*segment),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	entries := make(map[uint64]JournalEntry)
+	for _, path := range paths {
+		if err := j.load(path, entries); err != nil {
+			return nil, err
+		}
+	}
+	for seq, e := range entries {
+		if _, ok := j.unacked[seq]; ok {
+			j.replay = append(j.replay, e)
+		}
+	}
+	sort.Sort(bySeq(j.replay))
+
+	if err := j.rotate(); err != nil {
+		return nil, err
+	}
+	j.compact()
+	return j, nil
+}
+
+// Append records an event and syncs it to disk.
+func (j *FileJournal) Append(e JournalEntry) (uint64, error) {
+	payload, err := encodeEntry(e)
+	if err != nil {
+		return 0, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return 0, ErrJournalClosed
+	}
+
+	seq := j.next
+	size := j.size
+	if err := j.write(recordAppend, seq, payload); err != nil {
+		return 0, err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.discard(size)
+		return 0, err
+	}
+	j.next++
+
+	seg := j.segments[len(j.segments)-1]
+	seg.unacked++
+	j.unacked[seq] = seg
+
+	if j.size >= j.segmentSize {
+		if err := j.rotate(); err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// Ack marks an event as handled. Unknown sequence numbers are ignored.
+func (j *FileJournal) Ack(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+
+	seg, ok := j.unacked[seq]
+	if !ok {
+		return nil
+	}
+	if err := j.write(recordAck, seq, nil); err != nil {
+		return err
+	}
+	delete(j.unacked, seq)
+	seg.unacked--
+	j.compact()
+	return nil
+}
+
+// Pending returns the events which were not acknowledged when the journal was
+// opened and have not been acknowledged since.
+func (j *FileJournal) Pending() ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var pending []JournalEntry
+	for _, e := range j.replay {
+		if _, ok := j.unacked[e.Seq]; ok {
+			pending = append(pending, e)
+		}
+	}
+	return pending, nil
+}
+
+// Close closes the current segment.
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	return j.file.Close()
+}
+
+// load reads the records of a segment file. A truncated or corrupt record
+// ends the segment and the file is truncated before it.
+func (j *FileJournal) load(path string, entries map[uint64]JournalEntry) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seg := &segment{path: path}
+	j.segments = append(j.segments, seg)
+
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		kind := header[0]
+		seq := binary.BigEndian.Uint64(header[1:9])
+		length := binary.BigEndian.Uint32(header[9:13])
+		sum := binary.BigEndian.Uint32(header[13:17])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil || crc32.ChecksumIEEE(payload) != sum {
+			break
+		}
+		offset += int64(recordHeaderSize) + int64(length)
+
+		switch kind {
+		case recordAppend:
+			e, err := decodeEntry(payload)
+			if err != nil {
+				return fmt.Errorf("serfer: corrupt journal entry %d in %s: %v", seq, path, err)
+			}
+			e.Seq = seq
+			entries[seq] = e
+			j.unacked[seq] = seg
+			seg.unacked++
+			if seq >= j.next {
+				j.next = seq + 1
+			}
+		case recordAck:
+			if s, ok := j.unacked[seq]; ok {
+				delete(j.unacked, seq)
+				s.unacked--
+			}
+		}
+	}
+	return f.Truncate(offset)
+}
+
+// rotate closes the current segment and starts a new one. It must be called
+// with the lock held.
+func (j *FileJournal) rotate() error {
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(j.dir, fmt.Sprintf("%020d%s", j.next, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	j.file = f
+	j.size = info.Size()
+	if n := len(j.segments); n == 0 || j.segments[n-1].path != path {
+		j.segments = append(j.segments, &segment{path: path})
+	}
+	return nil
+}
+
+// compact deletes the oldest segments which have no pending events. Segments
+// are only deleted in order so that acknowledgements are never lost before
+// the events they refer to. It must be called with the lock held.
+func (j *FileJournal) compact() {
+	for len(j.segments) > 1 && j.segments[0].unacked == 0 {
+		os.Remove(j.segments[0].path)
+		j.segments[0] = nil
+		j.segments = j.segments[1:]
+	}
+}
+
+// write appends a record to the current segment. It must be called with the
+// lock held.
+func (j *FileJournal) write(kind byte, seq uint64, payload []byte) error {
+	buf := make([]byte, recordHeaderSize+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], seq)
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[13:17], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	if _, err := j.file.Write(buf); err != nil {
+		j.discard(j.size)
+		return err
+	}
+	j.size += int64(len(buf))
+	return nil
+}
+
+// discard removes whatever was written to the current segment after size, so
+// that a record which failed to be written or synced does not hide the records
+// written after it when the journal is loaded. If the segment cannot be
+// truncated, a new segment is started instead. It must be called with the
+// lock held.
+func (j *FileJournal) discard(size int64) {
+	if err := j.file.Truncate(size); err == nil {
+		j.size = size
+		return
+	}
+	j.file.Close()
+	j.file = nil
+	j.rotate()
+}
+
+// encodeEntry encodes a journal entry with msgpack.
+func encodeEntry(e JournalEntry) ([]byte, error) {
+	rec := journalRecord{Source: e.Source, Received: e.Received.UnixNano()}
+	switch evt := e.Event.(type) {
+	case serf.MemberEvent:
+		rec.Type = evt.Type
+		rec.Members = evt.Members
+	case serf.UserEvent:
+		rec.Type = serf.EventUser
+		rec.Name = evt.Name
+		rec.Payload = evt.Payload
+		rec.LTime = evt.LTime
+		rec.Coalesce = evt.Coalesce
+	case *serf.Query:
+		rec.Type = serf.EventQuery
+		rec.Name = evt.Name
+		rec.Payload = evt.Payload
+		rec.LTime = evt.LTime
+	default:
+		return nil, fmt.Errorf("serfer: cannot journal %T", e.Event)
+	}
+
+	var buf bytes.Buffer
+	var handle codec.MsgpackHandle
+	if err := codec.NewEncoder(&buf, &handle).Encode(&rec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeEntry decodes a journal entry encoded by encodeEntry.
+func decodeEntry(b []byte) (JournalEntry, error) {
+	var rec journalRecord
+	var handle codec.MsgpackHandle
+	if err := codec.NewDecoder(bytes.NewReader(b), &handle).Decode(&rec); err != nil {
+		return JournalEntry{}, err
+	}
+
+	e := JournalEntry{Source: rec.Source, Received: time.Unix(0, rec.Received)}
+	switch rec.Type {
+	case serf.EventUser:
+		e.Event = serf.UserEvent{LTime: rec.LTime, Name: rec.Name, Payload: rec.Payload, Coalesce: rec.Coalesce}
+	case serf.EventQuery:
+		e.Event = &serf.Query{LTime: rec.LTime, Name: rec.Name, Payload: rec.Payload}
+	default:
+		e.Event = serf.MemberEvent{Type: rec.Type, Members: rec.Members}
+	}
+	return e, nil
+}
+
+// bySeq sorts journal entries by sequence number.
+type bySeq []JournalEntry
+
+func (b bySeq) Len() int           { return len(b) }
+func (b bySeq) Less(i, j int) bool { return b[i].Seq < b[j].Seq }
+func (b bySeq) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// ticket tracks the parts of a journaled event which are still being handled.
+// The entry is acknowledged when the last part is done.
+type ticket struct {
+	seq   uint64
+	parts int32
+}
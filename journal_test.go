@@ -0,0 +1,266 @@
+package serfer
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func tempJournal(t *testing.T, segmentSize int64) (string, *FileJournal) {
+	dir, err := ioutil.TempDir("", "serfer-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenFileJournal(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, j
+}
+
+func segments(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestFileJournal_ReplaysUnacknowledged(t *testing.T) {
+	dir, j := tempJournal(t, 0)
+	defer os.RemoveAll(dir)
+
+	received := time.Unix(1440000000, 0)
+	join := serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{
+		{Name: "a", Addr: net.ParseIP("10.0.0.1"), Port: 7946, Tags: map[string]string{"role": "db"}, Status: serf.StatusAlive},
+	}}
+	user := serf.UserEvent{LTime: 3, Name: "deploy", Payload: []byte("v1"), Coalesce: true}
+	query := &serf.Query{LTime: 4, Name: "ping", Payload: []byte("hi")}
+
+	for i, e := range []serf.Event{join, user, query} {
+		seq, err := j.Append(JournalEntry{Source: "lan", Received: received, Event: e})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), seq)
+	}
+	assert.Nil(t, j.Ack(2))
+	assert.Nil(t, j.Ack(42), "unknown sequence numbers are ignored")
+	assert.Nil(t, j.Close())
+
+	j, err := OpenFileJournal(dir, 0)
+	assert.Nil(t, err)
+	pending, err := j.Pending()
+	assert.Nil(t, err)
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, uint64(1), pending[0].Seq)
+		assert.Equal(t, "lan", pending[0].Source)
+		assert.True(t, received.Equal(pending[0].Received))
+		me := pending[0].Event.(serf.MemberEvent)
+		assert.Equal(t, serf.EventMemberJoin, me.Type)
+		assert.Equal(t, "a", me.Members[0].Name)
+		assert.Equal(t, "10.0.0.1", me.Members[0].Addr.String())
+		assert.Equal(t, "db", me.Members[0].Tags["role"])
+
+		assert.Equal(t, uint64(3), pending[1].Seq)
+		q := pending[1].Event.(*serf.Query)
+		assert.Equal(t, "ping", q.Name)
+		assert.Equal(t, []byte("hi"), q.Payload)
+		assert.Equal(t, serf.LamportTime(4), q.LTime)
+	}
+
+	// Sequence numbers continue after a restart
+	seq, err := j.Append(JournalEntry{Event: user})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), seq)
+
+	assert.Nil(t, j.Ack(1))
+	pending, _ = j.Pending()
+	assert.Len(t, pending, 1)
+	assert.Nil(t, j.Close())
+	assert.Equal(t, ErrJournalClosed, j.Ack(3))
+}
+
+func TestFileJournal_TruncatedRecord(t *testing.T) {
+	dir, j := tempJournal(t, 0)
+	defer os.RemoveAll(dir)
+
+	j.Append(JournalEntry{Event: userEvent("a", 1, false)})
+	j.Append(JournalEntry{Event: userEvent("b", 2, false)})
+	assert.Nil(t, j.Close())
+
+	// Simulate a crash in the middle of the last write
+	paths := segments(t, dir)
+	info, err := os.Stat(paths[len(paths)-1])
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(paths[len(paths)-1], info.Size()-3))
+
+	j, err = OpenFileJournal(dir, 0)
+	assert.Nil(t, err)
+	pending, _ := j.Pending()
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "a", pending[0].Event.(serf.UserEvent).Name)
+	}
+
+	seq, err := j.Append(JournalEntry{Event: userEvent("c", 3, false)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.Nil(t, j.Close())
+
+	j, err = OpenFileJournal(dir, 0)
+	assert.Nil(t, err)
+	pending, _ = j.Pending()
+	assert.Len(t, pending, 2)
+	assert.Nil(t, j.Close())
+}
+
+func TestFileJournal_FailedWrite(t *testing.T) {
+	dir, j := tempJournal(t, 0)
+	defer os.RemoveAll(dir)
+
+	_, err := j.Append(JournalEntry{Event: userEvent("a", 1, false)})
+	assert.Nil(t, err)
+
+	// A partial record left by a failed write is truncated
+	size := j.size
+	_, err = j.file.Write([]byte{recordAppend, 0, 0})
+	assert.Nil(t, err)
+	j.discard(size)
+	info, err := j.file.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+
+	// A segment which cannot be written to is replaced
+	j.file.Close()
+	_, err = j.Append(JournalEntry{Event: userEvent("b", 2, false)})
+	assert.NotNil(t, err)
+	seq, err := j.Append(JournalEntry{Event: userEvent("c", 3, false)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.Len(t, segments(t, dir), 2)
+	assert.Nil(t, j.Close())
+
+	j, err = OpenFileJournal(dir, 0)
+	assert.Nil(t, err)
+	pending, _ := j.Pending()
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, "a", pending[0].Event.(serf.UserEvent).Name)
+		assert.Equal(t, "c", pending[1].Event.(serf.UserEvent).Name)
+	}
+	assert.Nil(t, j.Close())
+}
+
+func TestFileJournal_DeletesAcknowledgedSegments(t *testing.T) {
+	dir, j := tempJournal(t, 1)
+	defer os.RemoveAll(dir)
+
+	// Every append fills a segment
+	for i := 1; i <= 3; i++ {
+		j.Append(JournalEntry{Event: userEvent("a", i, false)})
+	}
+	assert.Len(t, segments(t, dir), 4)
+
+	// Newer segments are kept until older ones are acknowledged
+	assert.Nil(t, j.Ack(2))
+	assert.Len(t, segments(t, dir), 4)
+	assert.Nil(t, j.Ack(1))
+	assert.Len(t, segments(t, dir), 2)
+	assert.Nil(t, j.Ack(3))
+	assert.Len(t, segments(t, dir), 1)
+	assert.Nil(t, j.Close())
+
+	j, err := OpenFileJournal(dir, 1)
+	assert.Nil(t, err)
+	pending, _ := j.Pending()
+	assert.Len(t, pending, 0)
+	assert.Nil(t, j.Close())
+}
+
+func TestSerfer_JournalReplay(t *testing.T) {
+	dir, j := tempJournal(t, 0)
+	defer os.RemoveAll(dir)
+
+	// Events journaled by a previous process which crashed
+	j.Append(JournalEntry{Source: DefaultSource, Event: memberEvent(serf.EventMemberJoin, "a", "b", "c")})
+	j.Append(JournalEntry{Source: "gone", Event: memberEvent(serf.EventMemberLeave, "d")})
+	assert.Nil(t, j.Close())
+
+	j, err := OpenFileJournal(dir, 0)
+	assert.Nil(t, err)
+	defer j.Close()
+
+	handler := &recordingHandler{}
+	ch := make(chan serf.Event, 1)
+	conf := DefaultConfig()
+	conf.Workers = 2
+	conf.Journal = j
+	s := NewSerferConfig(ch, handler, conf)
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberFailed, "e")
+	close(ch)
+	assert.Equal(t, ErrSourceClosed, s.Wait())
+
+	recorded := handler.recorded()
+	assert.Len(t, recorded, 5)
+	for _, name := range []string{"a:member-join", "b:member-join", "c:member-join", "d:member-leave", "e:member-failed"} {
+		assert.Contains(t, recorded, name)
+	}
+
+	pending, _ := j.Pending()
+	assert.Len(t, pending, 0)
+	assert.Len(t, segments(t, dir), 1)
+}
+
+func TestSerfer_JournalKeepsAbandonedEvents(t *testing.T) {
+	dir, j := tempJournal(t, 0)
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	handler := &recordingHandler{block: map[string]chan struct{}{"a": release}}
+	ch := make(chan serf.Event, 5)
+	conf := DefaultConfig()
+	conf.Journal = j
+	s := NewSerferConfig(ch, handler, conf)
+	for i := 0; i < 5; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a")
+	}
+	s.Start()
+	waitFor(t, func() bool {
+		return len(ch) == 0
+	})
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		close(release)
+	})
+	n, err := s.StopWithTimeout(10 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, n > 0, "events should have been abandoned")
+	assert.Nil(t, j.Close())
+
+	// The abandoned events are replayed by the next Serfer
+	j, err = OpenFileJournal(dir, 0)
+	assert.Nil(t, err)
+	defer j.Close()
+	pending, _ := j.Pending()
+	assert.Len(t, pending, n)
+
+	replayed := &contextHandler{make(chan context.Context, n)}
+	conf.Journal = j
+	s = NewSerferConfig(make(chan serf.Event), replayed, conf)
+	s.Start()
+	for i := 0; i < n; i++ {
+		select {
+		case ctx := <-replayed.contexts:
+			assert.True(t, Replayed(ctx))
+		case <-time.After(time.Second):
+			t.Fatal("Abandoned event was not replayed")
+		}
+	}
+	assert.Nil(t, s.Stop())
+}
@@ -0,0 +1,252 @@
+package serfer
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// MemberJoinedHandler handles the members of join events one at a time.
+type MemberJoinedHandler interface {
+	HandleMemberJoined(serf.Member)
+}
+
+// MemberUpdatedHandler handles the members of update events one at a time.
+type MemberUpdatedHandler interface {
+	HandleMemberUpdated(serf.Member)
+}
+
+// MemberLeftHandler handles the members of leave events one at a time.
+type MemberLeftHandler interface {
+	HandleMemberLeft(serf.Member)
+}
+
+// MemberFailedHandler handles the members of failure events one at a time.
+type MemberFailedHandler interface {
+	HandleMemberFailed(serf.Member)
+}
+
+// MemberReapedHandler handles the members of reap events one at a time.
+type MemberReapedHandler interface {
+	HandleMemberReaped(serf.Member)
+}
+
+// MemberJoinedErrHandler handles joined members with a context and reports failure.
+type MemberJoinedErrHandler interface {
+	HandleMemberJoinedErr(context.Context, serf.Member) error
+}
+
+// MemberUpdatedErrHandler handles updated members with a context and reports failure.
+type MemberUpdatedErrHandler interface {
+	HandleMemberUpdatedErr(context.Context, serf.Member) error
+}
+
+// MemberLeftErrHandler handles departed members with a context and reports failure.
+type MemberLeftErrHandler interface {
+	HandleMemberLeftErr(context.Context, serf.Member) error
+}
+
+// MemberFailedErrHandler handles failed members with a context and reports failure.
+type MemberFailedErrHandler interface {
+	HandleMemberFailedErr(context.Context, serf.Member) error
+}
+
+// MemberReapedErrHandler handles reaped members with a context and reports failure.
+type MemberReapedErrHandler interface {
+	HandleMemberReapedErr(context.Context, serf.Member) error
+}
+
+// Batch describes the member event a member was split from. A Serfer with
+// several workers splits member events between them, so each worker only
+// handles a part of the event. Index, Size and Members describe the whole
+// event while Part and PartIndex describe the part being handled.
+type Batch struct {
+
+	// Type is the type of the member event.
+	Type serf.EventType
+
+	// Index is the position of the member in the event.
+	Index int
+
+	// Size is the number of members in the event.
+	Size int
+
+	// Members are all the members of the event.
+	Members []serf.Member
+
+	// Part are the members of the event passed to the handler. They are all
+	// the Members unless the event was split between workers.
+	Part []serf.Member
+
+	// PartIndex is the position of the member in Part.
+	PartIndex int
+}
+
+// First returns true for the first member of the part being handled.
+func (b Batch) First() bool {
+	return b.PartIndex == 0
+}
+
+// Last returns true for the last member of the part being handled, so that
+// handlers can flush their work on it even when the event was split.
+func (b Batch) Last() bool {
+	return b.PartIndex == len(b.Part)-1
+}
+
+// BatchFromContext returns the batch of the member being handled by a
+// per-member handler.
+func BatchFromContext(ctx context.Context) (Batch, bool) {
+	b, ok := ctx.Value(batchKey).(Batch)
+	return b, ok
+}
+
+// withBatch returns a context carrying the batch of a member.
+func withBatch(ctx context.Context, b Batch) context.Context {
+	return context.WithValue(ctx, batchKey, b)
+}
+
+// MemberSplitter adapts per-member handlers, such as MemberJoinedHandler, to
+// the member event handler interfaces. Serf coalesces membership changes, so
+// a single event may contain many members; MemberSplitter calls the handler
+// once per member, in order. The error variants receive a context from which
+// BatchFromContext returns the event the member was split from, so handlers
+// can still group their work, for instance by flushing on the last member of
+// the part they handle.
+//
+// All members are handled even when some fail and the first error is
+// returned. Splitting stops early if the context is done. MemberSplitter
+// ignores events which the wrapped handler does not handle.
+type MemberSplitter struct {
+	Handler interface{}
+}
+
+// splitMembers calls fn for every member of the event with the batch in the
+// context. The batch describes the event the Serfer split e from, if any.
+func splitMembers(ctx context.Context, e serf.MemberEvent, fn func(context.Context, serf.Member) error) error {
+	whole := e
+	if o, ok := originFromContext(ctx).(serf.MemberEvent); ok && o.Type == e.Type {
+		whole = o
+	}
+	index := make(map[string]int, len(whole.Members))
+	for i, m := range whole.Members {
+		index[m.Name] = i
+	}
+
+	var err error
+	for i, m := range e.Members {
+		if ctx.Err() != nil {
+			if err == nil {
+				err = ctx.Err()
+			}
+			return err
+		}
+
+		b := Batch{Type: e.Type, Index: i, Size: len(e.Members), Members: e.Members, Part: e.Members, PartIndex: i}
+		if j, ok := index[m.Name]; ok {
+			b.Index, b.Size, b.Members = j, len(whole.Members), whole.Members
+		}
+		if merr := fn(withBatch(ctx, b), m); err == nil {
+			err = merr
+		}
+	}
+	return err
+}
+
+// HandleMemberJoin passes each member to a MemberJoinedHandler.
+func (s MemberSplitter) HandleMemberJoin(e serf.MemberEvent) {
+	s.HandleMemberJoinErr(context.Background(), e)
+}
+
+// HandleMemberJoinErr passes each member to a MemberJoinedHandler.
+func (s MemberSplitter) HandleMemberJoinErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := s.Handler.(MemberJoinedHandler)
+	if !ok {
+		return nil
+	}
+	return splitMembers(ctx, e, func(ctx context.Context, m serf.Member) error {
+		if c, ok := h.(MemberJoinedErrHandler); ok {
+			return c.HandleMemberJoinedErr(ctx, m)
+		}
+		h.HandleMemberJoined(m)
+		return nil
+	})
+}
+
+// HandleMemberUpdate passes each member to a MemberUpdatedHandler.
+func (s MemberSplitter) HandleMemberUpdate(e serf.MemberEvent) {
+	s.HandleMemberUpdateErr(context.Background(), e)
+}
+
+// HandleMemberUpdateErr passes each member to a MemberUpdatedHandler.
+func (s MemberSplitter) HandleMemberUpdateErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := s.Handler.(MemberUpdatedHandler)
+	if !ok {
+		return nil
+	}
+	return splitMembers(ctx, e, func(ctx context.Context, m serf.Member) error {
+		if c, ok := h.(MemberUpdatedErrHandler); ok {
+			return c.HandleMemberUpdatedErr(ctx, m)
+		}
+		h.HandleMemberUpdated(m)
+		return nil
+	})
+}
+
+// HandleMemberLeave passes each member to a MemberLeftHandler.
+func (s MemberSplitter) HandleMemberLeave(e serf.MemberEvent) {
+	s.HandleMemberLeaveErr(context.Background(), e)
+}
+
+// HandleMemberLeaveErr passes each member to a MemberLeftHandler.
+func (s MemberSplitter) HandleMemberLeaveErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := s.Handler.(MemberLeftHandler)
+	if !ok {
+		return nil
+	}
+	return splitMembers(ctx, e, func(ctx context.Context, m serf.Member) error {
+		if c, ok := h.(MemberLeftErrHandler); ok {
+			return c.HandleMemberLeftErr(ctx, m)
+		}
+		h.HandleMemberLeft(m)
+		return nil
+	})
+}
+
+// HandleMemberFailure passes each member to a MemberFailedHandler.
+func (s MemberSplitter) HandleMemberFailure(e serf.MemberEvent) {
+	s.HandleMemberFailureErr(context.Background(), e)
+}
+
+// HandleMemberFailureErr passes each member to a MemberFailedHandler.
+func (s MemberSplitter) HandleMemberFailureErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := s.Handler.(MemberFailedHandler)
+	if !ok {
+		return nil
+	}
+	return splitMembers(ctx, e, func(ctx context.Context, m serf.Member) error {
+		if c, ok := h.(MemberFailedErrHandler); ok {
+			return c.HandleMemberFailedErr(ctx, m)
+		}
+		h.HandleMemberFailed(m)
+		return nil
+	})
+}
+
+// HandleMemberReap passes each member to a MemberReapedHandler.
+func (s MemberSplitter) HandleMemberReap(e serf.MemberEvent) {
+	s.HandleMemberReapErr(context.Background(), e)
+}
+
+// HandleMemberReapErr passes each member to a MemberReapedHandler.
+func (s MemberSplitter) HandleMemberReapErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := s.Handler.(MemberReapedHandler)
+	if !ok {
+		return nil
+	}
+	return splitMembers(ctx, e, func(ctx context.Context, m serf.Member) error {
+		if c, ok := h.(MemberReapedErrHandler); ok {
+			return c.HandleMemberReapedErr(ctx, m)
+		}
+		h.HandleMemberReaped(m)
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package serfer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// memberRecorder records the members it handles one at a time.
+type memberRecorder struct {
+	handled []string
+	fail    map[string]bool
+}
+
+func (r *memberRecorder) HandleMemberJoined(m serf.Member) {
+	r.handled = append(r.handled, "plain "+m.Name)
+}
+
+func (r *memberRecorder) HandleMemberJoinedErr(ctx context.Context, m serf.Member) error {
+	b, ok := BatchFromContext(ctx)
+	if !ok {
+		return errors.New("no batch")
+	}
+	r.handled = append(r.handled, fmt.Sprintf("%s %d/%d first=%v last=%v", m.Name, b.Index, b.Size, b.First(), b.Last()))
+	if r.fail[m.Name] {
+		return fmt.Errorf("%s failed", m.Name)
+	}
+	return nil
+}
+
+func (r *memberRecorder) HandleMemberFailed(m serf.Member) {
+	r.handled = append(r.handled, "failed "+m.Name)
+}
+
+func TestMemberSplitter(t *testing.T) {
+	rec := &memberRecorder{fail: map[string]bool{"b": true, "c": true}}
+	s := MemberSplitter{Handler: rec}
+
+	err := s.HandleMemberJoinErr(context.Background(), memberEvent(serf.EventMemberJoin, "a", "b", "c"))
+	assert.EqualError(t, err, "b failed", "the first error is returned")
+	assert.Equal(t, []string{
+		"a 0/3 first=true last=false",
+		"b 1/3 first=false last=false",
+		"c 2/3 first=false last=true",
+	}, rec.handled)
+
+	rec.handled = nil
+	s.HandleMemberFailure(memberEvent(serf.EventMemberFailed, "a", "b"))
+	s.HandleMemberLeave(memberEvent(serf.EventMemberLeave, "a"))
+	assert.Equal(t, []string{"failed a", "failed b"}, rec.handled)
+
+	rec.handled = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.HandleMemberJoinErr(ctx, memberEvent(serf.EventMemberJoin, "a")))
+	assert.Len(t, rec.handled, 0)
+}
+
+func TestSerfEventHandler_MemberSplitter(t *testing.T) {
+	rec := &memberRecorder{}
+	h := SerfEventHandler{
+		NodeJoined: MemberSplitter{Handler: rec},
+		NodeFailed: MemberSplitter{Handler: rec},
+		Logger:     &log.NullLogger{},
+	}
+
+	assert.Nil(t, h.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a", "b")))
+	h.HandleEvent(memberEvent(serf.EventMemberFailed, "c"))
+	assert.Equal(t, []string{
+		"a 0/2 first=true last=false",
+		"b 1/2 first=false last=true",
+		"failed c",
+	}, rec.handled)
+}
+
+// batchRecorder records the batch of every member it handles.
+type batchRecorder struct {
+	sync.Mutex
+	batches map[string]Batch
+}
+
+func (r *batchRecorder) HandleMemberJoined(m serf.Member) {}
+
+func (r *batchRecorder) HandleMemberJoinedErr(ctx context.Context, m serf.Member) error {
+	b, _ := BatchFromContext(ctx)
+	r.Lock()
+	r.batches[m.Name] = b
+	r.Unlock()
+	return nil
+}
+
+func TestSerfer_MemberSplitterBatch(t *testing.T) {
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("node-%d", i))
+	}
+	evt := memberEvent(serf.EventMemberJoin, names...)
+
+	rec := &batchRecorder{batches: make(map[string]Batch)}
+	ch := make(chan serf.Event, 1)
+	s := NewSerfer(ch, &SerfEventHandler{
+		NodeJoined: MemberSplitter{Handler: rec},
+		Logger:     &log.NullLogger{},
+	}, 4)
+	s.Start()
+	ch <- evt
+	n, err := s.StopWithTimeout(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// The batch describes the whole event even though it was split between workers
+	rec.Lock()
+	defer rec.Unlock()
+	assert.Len(t, rec.batches, len(names))
+	var parts int
+	for name, b := range rec.batches {
+		assert.Equal(t, len(names), b.Size)
+		assert.Equal(t, evt.Members, b.Members)
+		assert.Equal(t, name, b.Members[b.Index].Name)
+		assert.Equal(t, name, b.Part[b.PartIndex].Name)
+		assert.True(t, len(b.Part) < len(names), "each worker handles a part of the event")
+		if b.Last() {
+			parts++
+		}
+	}
+	assert.True(t, parts > 1, "the last member of each part is reported")
+}
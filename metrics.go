@@ -0,0 +1,45 @@
+package serfer
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+)
+
+// DefaultMetricsPrefix is the key prefix of the metrics emitted when no prefix
+// is configured.
+var DefaultMetricsPrefix = []string{"serfer"}
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeRetry   = "retry"
+	outcomePanic   = "panic"
+)
+
+// metricsKey returns a metrics key made of the prefix followed by parts.
+func metricsKey(prefix []string, parts ...string) []string {
+	if prefix == nil {
+		prefix = DefaultMetricsPrefix
+	}
+	key := make([]string, 0, len(prefix)+len(parts))
+	key = append(key, prefix...)
+	return append(key, parts...)
+}
+
+// outcome returns the outcome label of a handler result.
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// measureEvent emits the counter and timer of an event handled by a
+// SerfEventHandler.
+func measureEvent(prefix []string, e serf.Event, start time.Time, err error) {
+	name := eventTypeName(e)
+	metrics.IncrCounter(metricsKey(prefix, "events", name, outcome(err)), 1)
+	metrics.MeasureSince(metricsKey(prefix, "events", name), start)
+}
@@ -0,0 +1,117 @@
+package serfer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// sink receives the metrics emitted by every test. It is installed before any
+// test runs so that it is never swapped while metrics are emitted.
+var sink = metrics.NewInmemSink(time.Second, time.Minute)
+
+func init() {
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	metrics.NewGlobal(conf, sink)
+}
+
+// metricsSnapshot holds the counter totals and sample counts of the sink at
+// some point, so that tests only check the metrics they emitted themselves
+// however often they run.
+type metricsSnapshot struct {
+	counters map[string]int
+	samples  map[string]int
+}
+
+// snapshot returns the totals of the counters and timers across all retained
+// intervals.
+func snapshot() metricsSnapshot {
+	m := metricsSnapshot{counters: make(map[string]int), samples: make(map[string]int)}
+	for _, interval := range sink.Data() {
+		interval.RLock()
+		for name, c := range interval.Counters {
+			m.counters[name] += int(c.Sum)
+		}
+		for name, s := range interval.Samples {
+			m.samples[name] += s.Count
+		}
+		interval.RUnlock()
+	}
+	return m
+}
+
+// counter returns how much a counter grew since the snapshot was taken.
+func (m metricsSnapshot) counter(key ...string) int {
+	name := strings.Join(key, ".")
+	return snapshot().counters[name] - m.counters[name]
+}
+
+// sampled returns the number of samples of a timer since the snapshot was taken.
+func (m metricsSnapshot) sampled(key ...string) int {
+	name := strings.Join(key, ".")
+	return snapshot().samples[name] - m.samples[name]
+}
+
+func TestSerfEventHandler_Metrics(t *testing.T) {
+	rec := &flakyReconciler{}
+	h := SerfEventHandler{
+		ServicePrefix:   "svc",
+		IsLeader:        func() bool { return true },
+		IsLeaderEvent:   func(string) bool { return false },
+		NodeJoined:      failingJoin{errors.New("unavailable")},
+		UserEvent:       panickingUser{},
+		Reconciler:      rec,
+		ReconcileOnJoin: true,
+		Retry:           &RetryPolicy{MaxAttempts: 2},
+		MetricsPrefix:   []string{"test", "handler"},
+		Logger:          &log.NullLogger{},
+	}
+
+	m := snapshot()
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a", "b"))
+	h.HandleEvent(userEvent("svc:deploy", 1, false))
+	h.UserEventMetrics = true
+	h.HandleEvent(userEvent("svc:deploy", 1, false))
+
+	assert.Equal(t, 1, m.counter("test", "handler", "events", "member-join", "failure"))
+	assert.Equal(t, 1, m.sampled("test", "handler", "events", "member-join"))
+	assert.Equal(t, 2, m.counter("test", "handler", "events", "user", "success"))
+	assert.Equal(t, 1, m.counter("test", "handler", "user", "success"), "event names are left out by default")
+	assert.Equal(t, 1, m.counter("test", "handler", "user", "deploy", "success"))
+	assert.Equal(t, 1, m.counter("test", "handler", "handler", "member-join", "retry"))
+	assert.Equal(t, 1, m.counter("test", "handler", "handler", "member-join", "failure"))
+	assert.Equal(t, 2, m.counter("test", "handler", "handler", "reconcile", "success"))
+	assert.Equal(t, 2, m.counter("test", "handler", "reconcile", "success"))
+	assert.Equal(t, 1, m.sampled("test", "handler", "reconcile"))
+}
+
+func TestSerfer_Metrics(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Logger = &log.NullLogger{}
+	conf.MetricsPrefix = []string{"test", "serfer"}
+	ch := make(chan serf.Event, 3)
+	s := NewSerferConfig(ch, &panickingHandler{}, conf)
+
+	m := snapshot()
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	ch <- memberEvent(serf.EventMemberJoin, "bad")
+	ch <- userEvent("deploy", 1, false)
+	close(ch)
+	s.Start()
+	assert.Equal(t, ErrSourceClosed, s.Wait())
+
+	assert.Equal(t, 2, m.counter("test", "serfer", "received", "member-join"))
+	assert.Equal(t, 1, m.counter("test", "serfer", "received", "user"))
+	assert.Equal(t, 1, m.counter("test", "serfer", "dispatch", "member-join", "success"))
+	assert.Equal(t, 1, m.counter("test", "serfer", "dispatch", "member-join", "panic"))
+	assert.Equal(t, 1, m.counter("test", "serfer", "dispatch", "user", "success"))
+	assert.Equal(t, 2, m.sampled("test", "serfer", "latency", "member-join"))
+}
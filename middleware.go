@@ -0,0 +1,115 @@
+package serfer
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// HandlerFunc adapts a function to an EventHandler. It implements the context
+// and error variants, so errors and contexts pass through middleware.
+type HandlerFunc func(context.Context, serf.Event) error
+
+// HandleEvent calls f with a background context.
+func (f HandlerFunc) HandleEvent(e serf.Event) {
+	f(context.Background(), e)
+}
+
+// HandleEventContext calls f with the given context.
+func (f HandlerFunc) HandleEventContext(ctx context.Context, e serf.Event) {
+	f(ctx, e)
+}
+
+// HandleEventErr calls f with the given context and returns its error.
+func (f HandlerFunc) HandleEventErr(ctx context.Context, e serf.Event) error {
+	return f(ctx, e)
+}
+
+// Middleware wraps an EventHandler to add behavior before or after it.
+type Middleware func(EventHandler) EventHandler
+
+// Chain composes middleware into a single Middleware. The first middleware is
+// the outermost, so Chain(a, b)(h) handles an event with a, then b, then h.
+func Chain(middleware ...Middleware) Middleware {
+	return func(h EventHandler) EventHandler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			h = middleware[i](h)
+		}
+		return h
+	}
+}
+
+// Logging logs every event at debug level and the handler errors at warn level.
+func Logging(logger log.Logger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return HandlerFunc(func(ctx context.Context, e serf.Event) error {
+			logger.Debug("serfer: handling event", "event", e)
+			start := time.Now()
+			err := handleEvent(ctx, next, e)
+			if err != nil {
+				logger.Warn("serfer: event handler failed", "event", e, "duration", time.Since(start), "err", err)
+			}
+			return err
+		})
+	}
+}
+
+// Timing calls observe with the time taken to handle every event.
+func Timing(observe func(e serf.Event, d time.Duration)) Middleware {
+	return func(next EventHandler) EventHandler {
+		return HandlerFunc(func(ctx context.Context, e serf.Event) error {
+			start := time.Now()
+			err := handleEvent(ctx, next, e)
+			observe(e, time.Since(start))
+			return err
+		})
+	}
+}
+
+// Recovery recovers a panicking handler and returns the panic as a *PanicError.
+func Recovery() Middleware {
+	return func(next EventHandler) EventHandler {
+		return HandlerFunc(func(ctx context.Context, e serf.Event) error {
+			var err error
+			if perr := recoverEvent(e, func() {
+				err = handleEvent(ctx, next, e)
+			}); perr != nil {
+				return perr
+			}
+			return err
+		})
+	}
+}
+
+// Filter only passes the events for which keep returns true.
+func Filter(keep func(serf.Event) bool) Middleware {
+	return func(next EventHandler) EventHandler {
+		return HandlerFunc(func(ctx context.Context, e serf.Event) error {
+			if !keep(e) {
+				return nil
+			}
+			return handleEvent(ctx, next, e)
+		})
+	}
+}
+
+// Sampling passes a random fraction of the events given by rate, between 0
+// and 1. If types are given, only events of those types are sampled and the
+// others are always passed, so membership changes are not lost when sampling
+// user events.
+func Sampling(rate float64, types ...serf.EventType) Middleware {
+	sampled := make(map[serf.EventType]bool, len(types))
+	for _, t := range types {
+		sampled[t] = true
+	}
+
+	return Filter(func(e serf.Event) bool {
+		if len(sampled) > 0 && !sampled[e.EventType()] {
+			return true
+		}
+		return rand.Float64() < rate
+	})
+}
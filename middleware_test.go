@@ -0,0 +1,122 @@
+package serfer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// tracing returns a middleware appending its name to order around the next handler.
+func tracing(name string, order *[]string) Middleware {
+	return func(next EventHandler) EventHandler {
+		return HandlerFunc(func(ctx context.Context, e serf.Event) error {
+			*order = append(*order, name)
+			err := handleEvent(ctx, next, e)
+			*order = append(*order, "/"+name)
+			return err
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	errFailed := errors.New("failed")
+	h := Chain(tracing("a", &order), tracing("b", &order))(HandlerFunc(func(ctx context.Context, e serf.Event) error {
+		order = append(order, "handler")
+		return errFailed
+	}))
+
+	assert.Equal(t, errFailed, handleEvent(context.Background(), h, memberEvent(serf.EventMemberJoin, "a")))
+	assert.Equal(t, []string{"a", "b", "handler", "/b", "/a"}, order)
+
+	// An empty chain returns the handler
+	handler := &recordingHandler{}
+	assert.Equal(t, handler, Chain()(handler))
+}
+
+func TestMiddleware_Recovery(t *testing.T) {
+	h := Chain(Logging(&log.NullLogger{}), Recovery())(&panickingHandler{})
+
+	err := handleEvent(context.Background(), h, memberEvent(serf.EventMemberJoin, "bad"))
+	if assert.IsType(t, &PanicError{}, err) {
+		assert.Equal(t, "bad member", err.(*PanicError).Value)
+	}
+	assert.Nil(t, handleEvent(context.Background(), h, memberEvent(serf.EventMemberJoin, "a")))
+}
+
+func TestMiddleware_Timing(t *testing.T) {
+	var observed []time.Duration
+	h := Timing(func(e serf.Event, d time.Duration) {
+		observed = append(observed, d)
+	})(HandlerFunc(func(ctx context.Context, e serf.Event) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}))
+
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a"))
+	if assert.Len(t, observed, 1) {
+		assert.True(t, observed[0] >= 5*time.Millisecond)
+	}
+}
+
+func TestMiddleware_Filter(t *testing.T) {
+	handler := &recordingHandler{}
+	h := Filter(func(e serf.Event) bool {
+		return e.(serf.MemberEvent).Members[0].Name != "ignored"
+	})(handler)
+
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "ignored"))
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a"))
+	assert.Equal(t, []string{"a:member-join"}, handler.recorded())
+}
+
+func TestMiddleware_Sampling(t *testing.T) {
+	var users, members int
+	count := HandlerFunc(func(ctx context.Context, e serf.Event) error {
+		if e.EventType() == serf.EventUser {
+			users++
+		} else {
+			members++
+		}
+		return nil
+	})
+
+	none := Sampling(0, serf.EventUser)(count)
+	none.HandleEvent(userEvent("deploy", 1, false))
+	none.HandleEvent(memberEvent(serf.EventMemberJoin, "a"))
+	assert.Equal(t, 0, users)
+	assert.Equal(t, 1, members, "events of other types are not sampled")
+
+	all := Sampling(1)(count)
+	for i := 0; i < 10; i++ {
+		all.HandleEvent(userEvent("deploy", i, false))
+	}
+	assert.Equal(t, 10, users)
+
+	users = 0
+	half := Sampling(0.5)(count)
+	for i := 0; i < 1000; i++ {
+		half.HandleEvent(userEvent("deploy", i, false))
+	}
+	assert.InDelta(t, 500, users, 100)
+}
+
+func TestMiddleware_SerfEventHandler(t *testing.T) {
+	var kept int
+	handler := SerfEventHandler{
+		NodeJoined: failingJoin{errors.New("unavailable")},
+		Logger:     &log.NullLogger{},
+	}
+	h := Chain(Recovery(), Filter(func(e serf.Event) bool {
+		kept++
+		return true
+	}))(handler)
+
+	assert.NotNil(t, handleEvent(context.Background(), h, memberEvent(serf.EventMemberJoin, "a")), "errors pass through middleware")
+	assert.Equal(t, 1, kept)
+}
@@ -0,0 +1,234 @@
+package serfer
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// ErrDuplicatePattern is returned when a pattern is registered twice with a mux.
+var ErrDuplicatePattern = errors.New("serfer: duplicate pattern")
+
+// Params are the values of the path-style parameters of a matched pattern.
+type Params map[string]string
+
+// Get returns the value of a parameter, or an empty string if it is not set.
+func (p Params) Get(name string) string {
+	return p[name]
+}
+
+// ParamsFromContext returns the parameters extracted from the name of the
+// event being handled by a mux.
+func ParamsFromContext(ctx context.Context) Params {
+	p, _ := ctx.Value(paramsKey).(Params)
+	return p
+}
+
+// withParams returns a context carrying the parameters of a matched pattern.
+func withParams(ctx context.Context, p Params) context.Context {
+	return context.WithValue(ctx, paramsKey, p)
+}
+
+// pattern is a compiled mux pattern. Patterns containing path segments which
+// start with a colon are parameter patterns, patterns containing glob
+// metacharacters are glob patterns and any other pattern matches exactly.
+type pattern struct {
+	raw      string
+	segments []string
+	glob     bool
+}
+
+// compilePattern parses a pattern and checks that globs are well formed.
+func compilePattern(raw string) (pattern, error) {
+	p := pattern{raw: raw}
+	for _, s := range strings.Split(raw, "/") {
+		if strings.HasPrefix(s, ":") && len(s) > 1 {
+			p.segments = strings.Split(raw, "/")
+			return p, nil
+		}
+	}
+	if strings.ContainsAny(raw, `*?[\`) {
+		if _, err := path.Match(raw, ""); err != nil {
+			return p, err
+		}
+		p.glob = true
+	}
+	return p, nil
+}
+
+// exact returns true if the pattern only matches its own text.
+func (p pattern) exact() bool {
+	return !p.glob && p.segments == nil
+}
+
+// match returns whether the name matches the pattern and the parameters
+// extracted from it.
+func (p pattern) match(name string) (Params, bool) {
+	switch {
+	case p.glob:
+		ok, _ := path.Match(p.raw, name)
+		return nil, ok
+	case p.segments != nil:
+		parts := strings.Split(name, "/")
+		if len(parts) != len(p.segments) {
+			return nil, false
+		}
+		params := make(Params)
+		for i, s := range p.segments {
+			if strings.HasPrefix(s, ":") && len(s) > 1 {
+				if parts[i] == "" {
+					return nil, false
+				}
+				params[s[1:]] = parts[i]
+			} else if s != parts[i] {
+				return nil, false
+			}
+		}
+		return params, true
+	default:
+		return nil, p.raw == name
+	}
+}
+
+// router holds the patterns of a mux. Exact patterns take precedence over
+// parameter patterns, which take precedence over glob patterns. Patterns of
+// the same kind are tried in the order they were registered.
+type router struct {
+	mu     sync.RWMutex
+	exact  map[string]interface{}
+	params []route
+	globs  []route
+}
+
+// route is a pattern and the handler it routes to.
+type route struct {
+	pattern pattern
+	handler interface{}
+}
+
+// add registers a handler for a pattern.
+func (r *router) add(raw string, handler interface{}) error {
+	p, err := compilePattern(raw)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.exact[raw]; ok {
+		return ErrDuplicatePattern
+	}
+	for _, routes := range [][]route{r.params, r.globs} {
+		for _, rt := range routes {
+			if rt.pattern.raw == raw {
+				return ErrDuplicatePattern
+			}
+		}
+	}
+
+	switch {
+	case p.exact():
+		if r.exact == nil {
+			r.exact = make(map[string]interface{})
+		}
+		r.exact[raw] = handler
+	case p.glob:
+		r.globs = append(r.globs, route{p, handler})
+	default:
+		r.params = append(r.params, route{p, handler})
+	}
+	return nil
+}
+
+// lookup returns the handler for a name and the parameters extracted from it.
+func (r *router) lookup(name string) (interface{}, Params, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if h, ok := r.exact[name]; ok {
+		return h, nil, true
+	}
+	for _, routes := range [][]route{r.params, r.globs} {
+		for _, rt := range routes {
+			if params, ok := rt.pattern.match(name); ok {
+				return rt.handler, params, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// UserEventFunc adapts a function to a UserEventHandler.
+type UserEventFunc func(context.Context, serf.UserEvent) error
+
+// HandleUserEvent calls f with a background context.
+func (f UserEventFunc) HandleUserEvent(e serf.UserEvent) {
+	f(context.Background(), e)
+}
+
+// HandleUserEventErr calls f and returns its error.
+func (f UserEventFunc) HandleUserEventErr(ctx context.Context, e serf.UserEvent) error {
+	return f(ctx, e)
+}
+
+// UserEventMux is a UserEventHandler which routes user events to handlers by
+// name. Patterns are exact names such as "deploy", globs such as "deploy:*"
+// or path-style patterns such as "cache/:region/invalidate", whose parameters
+// are available to the handler through ParamsFromContext.
+//
+// Exact names take precedence over path-style patterns, which take precedence
+// over globs. Events which match no pattern are passed to NotFound, typically
+// the UnknownEventHandler of the SerfEventHandler, or ignored if it is nil.
+type UserEventMux struct {
+	router router
+
+	// NotFound handles the events which match no pattern.
+	NotFound UnknownEventHandler
+}
+
+// NewUserEventMux returns an empty UserEventMux.
+func NewUserEventMux() *UserEventMux {
+	return &UserEventMux{}
+}
+
+// Handle registers a handler for a pattern.
+func (m *UserEventMux) Handle(pattern string, handler UserEventHandler) error {
+	return m.router.add(pattern, handler)
+}
+
+// HandleFunc registers a function for a pattern.
+func (m *UserEventMux) HandleFunc(pattern string, fn func(context.Context, serf.UserEvent) error) error {
+	return m.Handle(pattern, UserEventFunc(fn))
+}
+
+// HandleUserEvent routes a user event to its handler.
+func (m *UserEventMux) HandleUserEvent(e serf.UserEvent) {
+	m.HandleUserEventErr(context.Background(), e)
+}
+
+// HandleUserEventContext routes a user event to its handler with a context.
+func (m *UserEventMux) HandleUserEventContext(ctx context.Context, e serf.UserEvent) {
+	m.HandleUserEventErr(ctx, e)
+}
+
+// HandleUserEventErr routes a user event to its handler with a context and
+// returns the error of the handler.
+func (m *UserEventMux) HandleUserEventErr(ctx context.Context, e serf.UserEvent) error {
+	h, params, ok := m.router.lookup(e.Name)
+	if !ok {
+		if m.NotFound != nil {
+			return handleUnknownEvent(ctx, m.NotFound, e)
+		}
+		return nil
+	}
+
+	if params != nil {
+		ctx = withParams(ctx, params)
+	}
+	return handleUserEvent(ctx, h.(UserEventHandler), e)
+}
@@ -0,0 +1,84 @@
+package serfer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// routed records which route handled each event and its parameters.
+type routed struct {
+	route  string
+	name   string
+	params Params
+}
+
+func recordRoute(route string, calls *[]routed) UserEventFunc {
+	return func(ctx context.Context, e serf.UserEvent) error {
+		*calls = append(*calls, routed{route, e.Name, ParamsFromContext(ctx)})
+		return nil
+	}
+}
+
+func TestUserEventMux_Routes(t *testing.T) {
+	var calls []routed
+	mux := NewUserEventMux()
+	assert.Nil(t, mux.Handle("deploy:*", recordRoute("glob", &calls)))
+	assert.Nil(t, mux.Handle("deploy:web", recordRoute("exact", &calls)))
+	assert.Nil(t, mux.Handle("cache/:region/invalidate", recordRoute("params", &calls)))
+	assert.Nil(t, mux.Handle("cache/*/invalidate", recordRoute("cache-glob", &calls)))
+
+	for _, name := range []string{"deploy:web", "deploy:db", "cache/us-east/invalidate", "cache//invalidate", "other"} {
+		mux.HandleUserEvent(userEvent(name, 1, false))
+	}
+
+	assert.Equal(t, []routed{
+		{"exact", "deploy:web", nil},
+		{"glob", "deploy:db", nil},
+		{"params", "cache/us-east/invalidate", Params{"region": "us-east"}},
+		{"cache-glob", "cache//invalidate", nil},
+	}, calls)
+	assert.Equal(t, "us-east", calls[2].params.Get("region"))
+}
+
+func TestUserEventMux_Register(t *testing.T) {
+	mux := NewUserEventMux()
+	assert.Nil(t, mux.Handle("deploy", &MockEventHandler{}))
+	assert.Equal(t, ErrDuplicatePattern, mux.Handle("deploy", &MockEventHandler{}))
+	assert.Nil(t, mux.Handle("a/:b", &MockEventHandler{}))
+	assert.Equal(t, ErrDuplicatePattern, mux.Handle("a/:b", &MockEventHandler{}))
+	assert.NotNil(t, mux.Handle("deploy:[", &MockEventHandler{}), "malformed globs are rejected")
+}
+
+func TestUserEventMux_NotFound(t *testing.T) {
+	unknown := &MockEventHandler{}
+	evt := userEvent("svc:missing", 1, false)
+	evt.Name = "missing"
+	unknown.On("HandleUnknownEvent", evt).Return()
+
+	errFailed := errors.New("failed")
+	mux := NewUserEventMux()
+	mux.NotFound = unknown
+	mux.HandleFunc("deploy", func(ctx context.Context, e serf.UserEvent) error {
+		return errFailed
+	})
+
+	// The mux plugs into a SerfEventHandler and sees the stripped names
+	h := SerfEventHandler{
+		ServicePrefix: "svc",
+		IsLeaderEvent: func(string) bool { return false },
+		UserEvent:     mux,
+		Logger:        &log.NullLogger{},
+	}
+	assert.Equal(t, errFailed, h.HandleEventErr(context.Background(), userEvent("svc:deploy", 1, false)))
+	assert.Nil(t, h.HandleEventErr(context.Background(), userEvent("svc:missing", 1, false)))
+	unknown.AssertCalled(t, "HandleUnknownEvent", evt)
+
+	// Without a NotFound handler unmatched events are ignored
+	mux.NotFound = nil
+	assert.Nil(t, mux.HandleUserEventErr(context.Background(), evt))
+}
@@ -0,0 +1,84 @@
+package serfer
+
+import (
+	"strings"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// Namespace handles the user events of one of the services sharing a cluster.
+// Its events are named with its prefix followed by the separator of the
+// SerfEventHandler, such as "billing:invoice".
+type Namespace struct {
+
+	// Prefix identifies the events of the service.
+	Prefix string
+
+	// IsLeaderEvent determines if an event of the namespace is a leader
+	// election event. It is called with the full event name.
+	IsLeaderEvent func(string) bool
+
+	// LeaderElectionHandler processes the leader election events of the namespace.
+	LeaderElectionHandler LeaderElectionHandler
+
+	// UserEvent processes the other events of the namespace. Their name is
+	// stripped of the prefix.
+	UserEvent UserEventHandler
+
+	// UnknownEventHandler processes the events of the namespace when it has no
+	// UserEvent handler. The event name is not stripped. If it is nil, the
+	// UnknownEventHandler of the SerfEventHandler is used.
+	UnknownEventHandler UnknownEventHandler
+}
+
+// namespace returns the namespace of an event. If several namespaces match,
+// the one with the longest prefix is returned.
+func (s *SerfEventHandler) namespace(name string) *Namespace {
+	var match *Namespace
+	for i := range s.Namespaces {
+		ns := &s.Namespaces[i]
+		if !strings.HasPrefix(name, ns.Prefix+s.separator()) {
+			continue
+		}
+		if match == nil || len(ns.Prefix) > len(match.Prefix) {
+			match = ns
+		}
+	}
+	return match
+}
+
+// handleNamespaceEvent dispatches a user event to the handlers of its namespace.
+func (s *SerfEventHandler) handleNamespaceEvent(ctx context.Context, ns *Namespace, event serf.UserEvent) error {
+	if ns.IsLeaderEvent != nil && ns.IsLeaderEvent(event.Name) {
+		s.Logger.Info("serfer: New leader elected", "namespace", ns.Prefix, "payload", string(event.Payload))
+		if ns.LeaderElectionHandler != nil {
+			return s.try(ctx, KindLeaderElection, event, func(ctx context.Context) error {
+				return handleLeaderElection(ctx, ns.LeaderElectionHandler, event)
+			})
+		}
+		return nil
+	}
+
+	if ns.UserEvent != nil {
+		event.Name = strings.TrimPrefix(event.Name, ns.Prefix+s.separator())
+		err := s.try(ctx, KindUserEvent, event, func(ctx context.Context) error {
+			return handleUserEvent(ctx, ns.UserEvent, event)
+		})
+		metrics.IncrCounter(s.userEventKey(event.Name, outcome(err), ns.Prefix), 1)
+		return err
+	}
+
+	// Namespaces without handlers leave their events to the service
+	unknown := ns.UnknownEventHandler
+	if unknown == nil {
+		unknown = s.UnknownEventHandler
+	}
+	if unknown != nil {
+		return s.try(ctx, KindUnknownEvent, event, func(ctx context.Context) error {
+			return handleUnknownEvent(ctx, unknown, event)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package serfer
+
+import (
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// userRecorder records the user events it receives, labelled by handler.
+type userRecorder struct {
+	label  string
+	events *[]string
+}
+
+func (u userRecorder) HandleUserEvent(e serf.UserEvent) {
+	*u.events = append(*u.events, u.label+" "+e.Name)
+}
+
+func (u userRecorder) HandleUnknownEvent(e serf.UserEvent) {
+	*u.events = append(*u.events, u.label+" unknown "+e.Name)
+}
+
+func (u userRecorder) HandleLeaderElection(e serf.UserEvent) {
+	*u.events = append(*u.events, u.label+" leader "+e.Name)
+}
+
+func TestSerfEventHandler_Namespaces(t *testing.T) {
+	var events []string
+	h := SerfEventHandler{
+		ServicePrefix:       "core",
+		Separator:           "/",
+		IsLeaderEvent:       func(name string) bool { return name == "core/leader" },
+		UserEvent:           userRecorder{"core", &events},
+		UnknownEventHandler: userRecorder{"core", &events},
+		Namespaces: []Namespace{
+			{Prefix: "billing", UserEvent: userRecorder{"billing", &events}},
+			{Prefix: "billing/eu", UserEvent: userRecorder{"billing-eu", &events}},
+			{
+				Prefix:                "search",
+				IsLeaderEvent:         func(name string) bool { return name == "search/leader" },
+				LeaderElectionHandler: userRecorder{"search", &events},
+				UnknownEventHandler:   userRecorder{"search", &events},
+			},
+			{Prefix: "audit"},
+		},
+		Logger: &log.NullLogger{},
+	}
+
+	for _, name := range []string{
+		"core/deploy",
+		"billing/invoice",
+		"billing/eu/invoice",
+		"search/leader",
+		"search/reindex",
+		"billing:invoice",
+		"audit/login",
+	} {
+		assert.Nil(t, h.HandleEventErr(context.Background(), userEvent(name, 1, false)))
+	}
+
+	assert.Equal(t, []string{
+		"core deploy",
+		"billing invoice",
+		"billing-eu invoice",
+		"search leader search/leader",
+		"search unknown search/reindex",
+		"core unknown billing:invoice",
+		"core unknown audit/login",
+	}, events)
+}
+
+func TestSerfEventHandler_DefaultSeparator(t *testing.T) {
+	var events []string
+	h := SerfEventHandler{
+		Namespaces: []Namespace{{Prefix: "billing", UserEvent: userRecorder{"billing", &events}}},
+		Logger:     &log.NullLogger{},
+	}
+
+	h.HandleEvent(userEvent("billing:invoice", 1, false))
+	h.HandleEvent(userEvent("billing/invoice", 1, false))
+	assert.Equal(t, []string{"billing invoice"}, events)
+}
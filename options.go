@@ -0,0 +1,281 @@
+package serfer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+)
+
+// Option configures a SerfEventHandler built by NewSerfEventHandler.
+type Option func(*SerfEventHandler) error
+
+// NewSerfEventHandler returns a SerfEventHandler configured by the given
+// options. Settings which are not configured get safe defaults: the local
+// node is never the leader, no event is a leader election event and nothing
+// is logged. The configuration is validated before it is returned.
+func NewSerfEventHandler(opts ...Option) (*SerfEventHandler, error) {
+	s := &SerfEventHandler{}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.IsLeader == nil {
+		if s.Reconciler != nil {
+			return nil, errors.New("serfer: a Reconciler is set but IsLeader is not, so it would never be called")
+		}
+		s.IsLeader = func() bool { return false }
+	}
+	if s.IsLeaderEvent == nil {
+		if s.LeaderElectionHandler != nil {
+			return nil, errors.New("serfer: a LeaderElectionHandler is set but IsLeaderEvent is not, so it would never be called")
+		}
+		s.IsLeaderEvent = func(string) bool { return false }
+	}
+	if s.Logger == nil {
+		s.Logger = log.NullLog
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	if s.Flaps != nil && s.Flaps.Stable == nil {
+		s.Flaps.Stable = s
+	}
+	return s, nil
+}
+
+// Validate checks that a SerfEventHandler can handle events without
+// panicking and that its settings are consistent.
+func (s *SerfEventHandler) Validate() error {
+	if s.Logger == nil {
+		return errors.New("serfer: Logger is not set")
+	}
+	if s.reconcileOn() && s.Reconciler == nil {
+		return errors.New("serfer: reconciliation is enabled but the Reconciler is not set")
+	}
+	if s.Reconciler != nil {
+		if !s.reconcileOn() {
+			return errors.New("serfer: the Reconciler is set but no ReconcileOn flag is, so it would never be called")
+		}
+		if s.IsLeader == nil {
+			return errors.New("serfer: the Reconciler is set but IsLeader is not")
+		}
+	}
+	if s.LeaderElectionHandler != nil && s.IsLeaderEvent == nil {
+		return errors.New("serfer: the LeaderElectionHandler is set but IsLeaderEvent is not")
+	}
+	if s.UserEvent != nil && s.ServicePrefix == "" {
+		return errors.New("serfer: the UserEvent handler is set but ServicePrefix is not")
+	}
+
+	prefixes := make(map[string]bool)
+	for _, ns := range s.Namespaces {
+		switch {
+		case ns.Prefix == "":
+			return errors.New("serfer: namespace without a prefix")
+		case prefixes[ns.Prefix]:
+			return fmt.Errorf("serfer: duplicate namespace %q", ns.Prefix)
+		case ns.LeaderElectionHandler != nil && ns.IsLeaderEvent == nil:
+			return fmt.Errorf("serfer: namespace %q has a LeaderElectionHandler but no IsLeaderEvent", ns.Prefix)
+		}
+		prefixes[ns.Prefix] = true
+	}
+
+	if s.Statuses == nil && (s.NodeTransitioned != nil || s.NodeRecovered != nil || s.NodeRejoined != nil) {
+		return errors.New("serfer: transition handlers are set but Statuses is not")
+	}
+	if r := s.Retry; r != nil && (r.MaxAttempts < 1 || r.InitialBackoff < 0 || r.MaxBackoff < 0 || r.Multiplier < 1 || r.Jitter < 0 || r.Jitter > 1) {
+		return fmt.Errorf("serfer: invalid retry policy %+v", *r)
+	}
+	return nil
+}
+
+// reconcileOn returns true if any member event is reconciled.
+func (s *SerfEventHandler) reconcileOn() bool {
+	return s.ReconcileOnJoin || s.ReconcileOnLeave || s.ReconcileOnFail || s.ReconcileOnUpdate || s.ReconcileOnReap
+}
+
+// WithServicePrefix sets the prefix of the user events of the service.
+func WithServicePrefix(prefix string) Option {
+	return func(s *SerfEventHandler) error {
+		if prefix == "" {
+			return errors.New("serfer: empty service prefix")
+		}
+		s.ServicePrefix = prefix
+		return nil
+	}
+}
+
+// WithSeparator sets the separator between prefixes and event names.
+func WithSeparator(sep string) Option {
+	return func(s *SerfEventHandler) error {
+		if sep == "" {
+			return errors.New("serfer: empty separator")
+		}
+		s.Separator = sep
+		return nil
+	}
+}
+
+// WithNamespace adds the namespace of another service.
+func WithNamespace(ns Namespace) Option {
+	return func(s *SerfEventHandler) error {
+		s.Namespaces = append(s.Namespaces, ns)
+		return nil
+	}
+}
+
+// WithLeader sets the function which determines if the local node is the leader.
+func WithLeader(isLeader IsLeaderFunc) Option {
+	return func(s *SerfEventHandler) error {
+		if isLeader == nil {
+			return errors.New("serfer: nil IsLeader function")
+		}
+		s.IsLeader = isLeader
+		return nil
+	}
+}
+
+// WithLeaderEvents sets the function which recognizes leader election events
+// and their handler.
+func WithLeaderEvents(isLeaderEvent func(string) bool, h LeaderElectionHandler) Option {
+	return func(s *SerfEventHandler) error {
+		if isLeaderEvent == nil || h == nil {
+			return errors.New("serfer: leader events need both a function and a handler")
+		}
+		s.IsLeaderEvent = isLeaderEvent
+		s.LeaderElectionHandler = h
+		return nil
+	}
+}
+
+// WithHandler sets the handler of a kind of event. The handler must
+// implement the interface of the kind, such as MemberJoinHandler for
+// KindMemberJoin. Each kind can only be set once; use the fan-out types, such
+// as MemberJoinHandlers, to call several handlers. The handlers of trackers,
+// such as KindFlap, are set with the option of their tracker instead.
+func WithHandler(kind HandlerKind, handler interface{}) Option {
+	return func(s *SerfEventHandler) error {
+		if handler == nil {
+			return fmt.Errorf("serfer: nil %s handler", kind)
+		}
+		if err := checkHandler(kind, handler); err != nil {
+			return err
+		}
+
+		f := handlerFields[kind]
+		if f.get(s) != nil {
+			return fmt.Errorf("serfer: %s handler is already set", kind)
+		}
+		f.set(s, handler)
+		return nil
+	}
+}
+
+// WithReconcileOn enables reconciliation for the given member event types.
+func WithReconcileOn(types ...serf.EventType) Option {
+	return func(s *SerfEventHandler) error {
+		for _, t := range types {
+			switch t {
+			case serf.EventMemberJoin:
+				s.ReconcileOnJoin = true
+			case serf.EventMemberLeave:
+				s.ReconcileOnLeave = true
+			case serf.EventMemberFailed:
+				s.ReconcileOnFail = true
+			case serf.EventMemberUpdate:
+				s.ReconcileOnUpdate = true
+			case serf.EventMemberReap:
+				s.ReconcileOnReap = true
+			default:
+				return fmt.Errorf("serfer: %s events cannot be reconciled", t)
+			}
+		}
+		return nil
+	}
+}
+
+// WithStatusTracking tracks the status of members and reports their
+// transitions to the given handlers, any of which may be nil.
+func WithStatusTracking(transitioned, recovered, rejoined TransitionHandler) Option {
+	return func(s *SerfEventHandler) error {
+		if s.Statuses == nil {
+			s.Statuses = NewStatusTracker()
+		}
+		s.NodeTransitioned = transitioned
+		s.NodeRecovered = recovered
+		s.NodeRejoined = rejoined
+		return nil
+	}
+}
+
+// WithTagTracker reports the tag changes of members to the handlers of the tracker.
+func WithTagTracker(t *TagTracker) Option {
+	return func(s *SerfEventHandler) error {
+		if t == nil {
+			return errors.New("serfer: nil TagTracker")
+		}
+		s.Tags = t
+		return nil
+	}
+}
+
+// WithFlapDetector suppresses the reconciliation of flapping members. Unless
+// the detector has a Stable handler, their last event is reconciled once they
+// are stable again.
+func WithFlapDetector(d *FlapDetector) Option {
+	return func(s *SerfEventHandler) error {
+		if d == nil {
+			return errors.New("serfer: nil FlapDetector")
+		}
+		s.Flaps = d
+		return nil
+	}
+}
+
+// WithRetry sets the policy used to retry failed handlers.
+func WithRetry(r *RetryPolicy) Option {
+	return func(s *SerfEventHandler) error {
+		s.Retry = r
+		return nil
+	}
+}
+
+// WithFailureHandler sets the handler notified of handlers which failed for good.
+func WithFailureHandler(h FailureHandler) Option {
+	return func(s *SerfEventHandler) error {
+		s.FailureHandler = h
+		return nil
+	}
+}
+
+// WithMetricsPrefix sets the prefix of the keys of the emitted metrics.
+func WithMetricsPrefix(prefix ...string) Option {
+	return func(s *SerfEventHandler) error {
+		s.MetricsPrefix = prefix
+		return nil
+	}
+}
+
+// WithUserEventMetrics adds the names of user events to the keys of their metrics.
+func WithUserEventMetrics() Option {
+	return func(s *SerfEventHandler) error {
+		s.UserEventMetrics = true
+		return nil
+	}
+}
+
+// WithLogger sets the logger.
+func WithLogger(l log.Logger) Option {
+	return func(s *SerfEventHandler) error {
+		if l == nil {
+			return errors.New("serfer: nil Logger")
+		}
+		s.Logger = l
+		return nil
+	}
+}
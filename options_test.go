@@ -0,0 +1,102 @@
+package serfer
+
+import (
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestNewSerfEventHandler_Defaults(t *testing.T) {
+	var events []string
+	h, err := NewSerfEventHandler(
+		WithServicePrefix("svc"),
+		WithHandler(KindUserEvent, userRecorder{"svc", &events}),
+		WithHandler(KindUnknownEvent, userRecorder{"svc", &events}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, h.IsLeader())
+	assert.NotNil(t, h.Logger)
+
+	// None of these panic with the defaults
+	for _, e := range []serf.Event{
+		userEvent("svc:deploy", 1, false),
+		userEvent("other", 1, false),
+		memberEvent(serf.EventMemberJoin, "a"),
+	} {
+		assert.Nil(t, h.HandleEventErr(context.Background(), e))
+	}
+	assert.Equal(t, []string{"svc deploy", "svc unknown other"}, events)
+}
+
+func TestNewSerfEventHandler_Reconciler(t *testing.T) {
+	rec := &flakyReconciler{}
+	h, err := NewSerfEventHandler(
+		WithLeader(func() bool { return true }),
+		WithHandler(KindReconcile, rec),
+		WithReconcileOn(serf.EventMemberJoin, serf.EventMemberFailed),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, h.ReconcileOnJoin)
+	assert.True(t, h.ReconcileOnFail)
+	assert.False(t, h.ReconcileOnLeave)
+
+	h.HandleEvent(memberEvent(serf.EventMemberJoin, "a", "b"))
+	assert.Equal(t, 2, rec.calls)
+}
+
+func TestNewSerfEventHandler_Invalid(t *testing.T) {
+	var events []string
+	for name, opts := range map[string][]Option{
+		"reconcile without reconciler": {WithReconcileOn(serf.EventMemberJoin)},
+		"reconciler without flags":     {WithLeader(func() bool { return true }), WithHandler(KindReconcile, &flakyReconciler{})},
+		"reconciler without leader":    {WithHandler(KindReconcile, &flakyReconciler{}), WithReconcileOn(serf.EventMemberJoin)},
+		"reconcile user events":        {WithReconcileOn(serf.EventUser)},
+		"wrong handler interface":      {WithHandler(KindMemberJoin, &flakyReconciler{})},
+		"handler set twice":            {WithHandler(KindQuery, &MockEventHandler{}), WithHandler(KindQuery, &MockEventHandler{})},
+		"user events without prefix":   {WithHandler(KindUserEvent, userRecorder{"svc", &events})},
+		"leader events without func":   {WithLeaderEvents(nil, userRecorder{"svc", &events})},
+		"leader handler without func":  {WithHandler(KindLeaderElection, userRecorder{"svc", &events})},
+		"duplicate namespaces":         {WithNamespace(Namespace{Prefix: "a"}), WithNamespace(Namespace{Prefix: "a"})},
+		"empty namespace":              {WithNamespace(Namespace{})},
+		"invalid retry policy":         {WithRetry(&RetryPolicy{})},
+		"shrinking retry backoff":      {WithRetry(&RetryPolicy{MaxAttempts: 3, Multiplier: 0.5})},
+		"retry jitter above 1":         {WithRetry(&RetryPolicy{MaxAttempts: 3, Multiplier: 2, Jitter: 1.5})},
+		"negative retry jitter":        {WithRetry(&RetryPolicy{MaxAttempts: 3, Multiplier: 2, Jitter: -0.1})},
+		"nil logger":                   {WithLogger(nil)},
+		"empty separator":              {WithSeparator("")},
+	} {
+		h, err := NewSerfEventHandler(opts...)
+		assert.NotNil(t, err, name)
+		assert.Nil(t, h, name)
+	}
+}
+
+func TestSerfEventHandler_Validate(t *testing.T) {
+	s := SerfEventHandler{}
+	assert.NotNil(t, s.Validate(), "the logger is required")
+
+	s = SerfEventHandler{
+		NodeRecovered: transitionRecorder{},
+		Logger:        &log.NullLogger{},
+	}
+	assert.NotNil(t, s.Validate(), "transitions need a status tracker")
+	s.Statuses = NewStatusTracker()
+	assert.Nil(t, s.Validate())
+
+	// Leader election events are optional
+	s.UnknownEventHandler = userRecorder{"svc", &[]string{}}
+	assert.Nil(t, s.HandleEventErr(context.Background(), userEvent("leader", 1, false)))
+
+	// Without IsLeader the local node is never the leader
+	rec := &flakyReconciler{}
+	s.Reconciler, s.ReconcileOnJoin = rec, true
+	assert.Nil(t, s.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a")))
+	assert.Equal(t, 0, rec.calls)
+}
@@ -0,0 +1,87 @@
+package serfer
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// PanicPolicy determines how a Serfer reacts when an event handler panics.
+type PanicPolicy int
+
+const (
+	// PanicContinue logs the panic and continues with the next event on the
+	// same worker.
+	PanicContinue PanicPolicy = iota
+
+	// PanicRestart logs the panic and replaces the worker loop which panicked
+	// with a new one, which continues with the next event of that worker.
+	// Restarts are counted in the worker_restarts statistic.
+	PanicRestart
+
+	// PanicStop stops the Serfer. Stop and Wait return a *PanicError.
+	PanicStop
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicContinue:
+		return "continue"
+	case PanicRestart:
+		return "restart"
+	case PanicStop:
+		return "stop"
+	default:
+		return "unknown"
+	}
+}
+
+// PanicError is returned when an event handler panics and the Serfer is
+// stopped because of it.
+type PanicError struct {
+	Event serf.Event
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("serfer: handler panicked on %v: %v", p.Event, p.Value)
+}
+
+// DeadLetter is an event whose handler panicked.
+type DeadLetter struct {
+
+	// Source is the name of the source the event was read from.
+	Source string
+
+	// Event is the event being handled.
+	Event serf.Event
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+
+	// Time is when the panic was recovered.
+	Time time.Time
+}
+
+// DeadLetterHandler receives events whose handler panicked so they can be
+// inspected and re-driven later.
+type DeadLetterHandler interface {
+	HandleDeadLetter(DeadLetter)
+}
+
+// recoverEvent calls fn and converts a panic into a *PanicError.
+func recoverEvent(e serf.Event, fn func()) (perr *PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr = &PanicError{Event: e, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	fn()
+	return nil
+}
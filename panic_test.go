@@ -0,0 +1,103 @@
+package serfer
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// panickingHandler panics on member events for the member named "bad".
+type panickingHandler struct {
+	recordingHandler
+}
+
+func (p *panickingHandler) HandleEvent(e serf.Event) {
+	if me, ok := e.(serf.MemberEvent); ok && me.Members[0].Name == "bad" {
+		panic("bad member")
+	}
+	p.recordingHandler.HandleEvent(e)
+}
+
+// deadLetters records dead letters.
+type deadLetters struct {
+	sync.Mutex
+	letters []DeadLetter
+}
+
+func (d *deadLetters) HandleDeadLetter(l DeadLetter) {
+	d.Lock()
+	d.letters = append(d.letters, l)
+	d.Unlock()
+}
+
+func (d *deadLetters) len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.letters)
+}
+
+func panicConfig(policy PanicPolicy, dl DeadLetterHandler) *Config {
+	conf := DefaultConfig()
+	conf.PanicPolicy = policy
+	conf.DeadLetterHandler = dl
+	conf.Logger = &log.NullLogger{}
+	return conf
+}
+
+func TestSerfer_PanicContinue(t *testing.T) {
+	handler := &panickingHandler{}
+	dl := &deadLetters{}
+	ch := make(chan serf.Event, 3)
+	s := NewSerferConfig(ch, handler, panicConfig(PanicContinue, dl))
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, "bad")
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	waitFor(t, func() bool {
+		return len(handler.recorded()) == 1
+	})
+	assert.Nil(t, s.Stop())
+
+	assert.Equal(t, 1, dl.len())
+	assert.Equal(t, memberEvent(serf.EventMemberJoin, "bad"), dl.letters[0].Event)
+	assert.Equal(t, "bad member", dl.letters[0].Value)
+	assert.NotEmpty(t, dl.letters[0].Stack)
+	assert.Equal(t, "0", s.Stats()["worker_restarts"])
+}
+
+func TestSerfer_PanicRestart(t *testing.T) {
+	handler := &panickingHandler{}
+	dl := &deadLetters{}
+	ch := make(chan serf.Event, 4)
+	s := NewSerferConfig(ch, handler, panicConfig(PanicRestart, dl))
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, "bad")
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	ch <- memberEvent(serf.EventMemberJoin, "bad")
+	ch <- memberEvent(serf.EventMemberJoin, "b")
+	waitFor(t, func() bool {
+		return len(handler.recorded()) == 2
+	})
+	assert.Equal(t, []string{"a:member-join", "b:member-join"}, handler.recorded())
+	assert.Equal(t, "2", s.Stats()["worker_restarts"])
+	assert.Equal(t, 2, dl.len())
+	assert.Nil(t, s.Stop())
+}
+
+func TestSerfer_PanicStop(t *testing.T) {
+	dl := &deadLetters{}
+	ch := make(chan serf.Event, 1)
+	s := NewSerferConfig(ch, &panickingHandler{}, panicConfig(PanicStop, dl))
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, "bad")
+	err := s.Wait()
+	if assert.IsType(t, &PanicError{}, err) {
+		assert.Equal(t, "bad member", err.(*PanicError).Value)
+	}
+	assert.Equal(t, 1, dl.len())
+}
@@ -0,0 +1,187 @@
+package serfer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrQueryExpired is returned when a query response is not sent because
+	// the deadline of the query has passed.
+	ErrQueryExpired error = permanentError{errors.New("serfer: query deadline passed")}
+
+	// ErrResponseTooLarge is returned when an encoded query response exceeds
+	// MaxQueryResponseSize. The querying side receives it as a QueryError.
+	ErrResponseTooLarge error = permanentError{fmt.Errorf("serfer: query response exceeds %d bytes", MaxQueryResponseSize)}
+
+	// ErrMalformedResponse is returned when a query response was not encoded
+	// with EncodeQueryResponse.
+	ErrMalformedResponse = errors.New("serfer: malformed query response")
+)
+
+// MaxQueryResponseSize is the size of the largest encoded response sent by a
+// QueryMux. Serf applies serf.QueryResponseSizeLimit to the response with its
+// framing, which takes up to 64 bytes, and the name of the responding node, so
+// room is left for node names of up to 192 bytes.
+const MaxQueryResponseSize = serf.QueryResponseSizeLimit - 64 - 192
+
+const (
+	responseOK    byte = 0
+	responseError byte = 1
+)
+
+// QueryError is an error returned by the query handler of a remote member.
+type QueryError struct {
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return "serfer: remote query failed: " + e.Message
+}
+
+// EncodeQueryResponse encodes the result of a query handler. The first byte
+// tells whether the rest is the payload or an error message.
+func EncodeQueryResponse(payload []byte, err error) []byte {
+	if err != nil {
+		msg := err.Error()
+		buf := make([]byte, 1+len(msg))
+		buf[0] = responseError
+		copy(buf[1:], msg)
+		return buf
+	}
+
+	buf := make([]byte, 1+len(payload))
+	buf[0] = responseOK
+	copy(buf[1:], payload)
+	return buf
+}
+
+// DecodeQueryResponse decodes a response encoded by EncodeQueryResponse, such
+// as the payload of a serf.NodeResponse. Errors of the remote handler are
+// returned as a *QueryError.
+func DecodeQueryResponse(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, ErrMalformedResponse
+	}
+	switch b[0] {
+	case responseOK:
+		return b[1:], nil
+	case responseError:
+		return nil, &QueryError{Message: string(b[1:])}
+	default:
+		return nil, ErrMalformedResponse
+	}
+}
+
+// QueryHandler answers a query. The returned payload or error is sent to the
+// querying member.
+type QueryHandler interface {
+	ServeQuery(context.Context, *serf.Query) ([]byte, error)
+}
+
+// QueryFunc adapts a function to a QueryHandler.
+type QueryFunc func(context.Context, *serf.Query) ([]byte, error)
+
+// ServeQuery calls f.
+func (f QueryFunc) ServeQuery(ctx context.Context, q *serf.Query) ([]byte, error) {
+	return f(ctx, q)
+}
+
+// QueryMux is a QueryEventHandler which routes queries to handlers by name,
+// using the same patterns as UserEventMux, and responds with the result
+// encoded by EncodeQueryResponse.
+//
+// Errors of the handlers are sent to the querying member rather than returned.
+// The errors returned by the mux are about the response: ErrQueryExpired if
+// the deadline passed before the handler was called or returned,
+// ErrResponseTooLarge if the encoded response exceeds MaxQueryResponseSize,
+// in which case that error is sent instead, or
+// the error of Respond. None of them is retried, since calling the handler
+// again cannot fix them. Queries which match no pattern are passed to
+// NotFound, or left unanswered if it is nil.
+type QueryMux struct {
+	router router
+
+	// NotFound answers the queries which match no pattern.
+	NotFound QueryHandler
+
+	// respond, deadline and now are replaced in tests since a serf.Query
+	// cannot be responded to without a running Serf.
+	respond  func(*serf.Query, []byte) error
+	deadline func(*serf.Query) time.Time
+	now      func() time.Time
+}
+
+// NewQueryMux returns an empty QueryMux.
+func NewQueryMux() *QueryMux {
+	return &QueryMux{
+		respond:  (*serf.Query).Respond,
+		deadline: (*serf.Query).Deadline,
+		now:      time.Now,
+	}
+}
+
+// Handle registers a handler for a pattern.
+func (m *QueryMux) Handle(pattern string, handler QueryHandler) error {
+	return m.router.add(pattern, handler)
+}
+
+// HandleFunc registers a function for a pattern.
+func (m *QueryMux) HandleFunc(pattern string, fn func(context.Context, *serf.Query) ([]byte, error)) error {
+	return m.Handle(pattern, QueryFunc(fn))
+}
+
+// HandleQueryEvent answers a query.
+func (m *QueryMux) HandleQueryEvent(q serf.Query) {
+	m.HandleQueryEventErr(context.Background(), &q)
+}
+
+// HandleQueryEventContext answers a query with a context.
+func (m *QueryMux) HandleQueryEventContext(ctx context.Context, q *serf.Query) {
+	m.HandleQueryEventErr(ctx, q)
+}
+
+// HandleQueryEventErr answers a query with a context and returns the error
+// which prevented the response from being sent.
+func (m *QueryMux) HandleQueryEventErr(ctx context.Context, q *serf.Query) error {
+	h, params, ok := m.router.lookup(q.Name)
+	if !ok {
+		if m.NotFound == nil {
+			return nil
+		}
+		h = m.NotFound
+	}
+	if params != nil {
+		ctx = withParams(ctx, params)
+	}
+
+	if m.expired(q) {
+		return ErrQueryExpired
+	}
+	resp := EncodeQueryResponse(h.(QueryHandler).ServeQuery(ctx, q))
+
+	var err error
+	if len(resp) > MaxQueryResponseSize {
+		resp = EncodeQueryResponse(nil, ErrResponseTooLarge)
+		err = ErrResponseTooLarge
+	}
+
+	if m.expired(q) {
+		return ErrQueryExpired
+	}
+	if rerr := m.respond(q, resp); rerr != nil {
+		return permanentError{rerr}
+	}
+	return err
+}
+
+// expired returns true if the deadline of a query has passed. Queries replayed
+// from the journal have no deadline.
+func (m *QueryMux) expired(q *serf.Query) bool {
+	deadline := m.deadline(q)
+	return deadline.IsZero() || m.now().After(deadline)
+}
@@ -0,0 +1,179 @@
+package serfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// testQueryMux returns a QueryMux which records responses instead of sending
+// them, with queries expiring at deadline and the clock reading now.
+func testQueryMux(responses *[][]byte, deadline, now time.Time) *QueryMux {
+	m := NewQueryMux()
+	m.respond = func(q *serf.Query, b []byte) error {
+		*responses = append(*responses, b)
+		return nil
+	}
+	m.deadline = func(*serf.Query) time.Time {
+		return deadline
+	}
+	m.now = func() time.Time {
+		return now
+	}
+	return m
+}
+
+func TestQueryResponse_Encoding(t *testing.T) {
+	payload, err := DecodeQueryResponse(EncodeQueryResponse([]byte("pong"), nil))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("pong"), payload)
+
+	_, err = DecodeQueryResponse(EncodeQueryResponse([]byte("ignored"), errors.New("not ready")))
+	if assert.IsType(t, &QueryError{}, err) {
+		assert.Equal(t, "not ready", err.(*QueryError).Message)
+	}
+
+	_, err = DecodeQueryResponse(nil)
+	assert.Equal(t, ErrMalformedResponse, err)
+	_, err = DecodeQueryResponse([]byte{42})
+	assert.Equal(t, ErrMalformedResponse, err)
+}
+
+func TestQueryMux_Responds(t *testing.T) {
+	var responses [][]byte
+	now := time.Now()
+	m := testQueryMux(&responses, now.Add(time.Second), now)
+	m.HandleFunc("ping", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		return append([]byte("pong:"), q.Payload...), nil
+	})
+	m.HandleFunc("status/:service", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		return nil, errors.New(ParamsFromContext(ctx).Get("service") + " is down")
+	})
+
+	// The mux plugs into a SerfEventHandler
+	h := SerfEventHandler{QueryHandler: m, Logger: &log.NullLogger{}}
+	assert.Nil(t, h.HandleEventErr(context.Background(), &serf.Query{Name: "ping", Payload: []byte("1")}))
+	assert.Nil(t, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "status/db"}))
+	assert.Nil(t, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "unknown"}))
+
+	if assert.Len(t, responses, 2) {
+		payload, err := DecodeQueryResponse(responses[0])
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("pong:1"), payload)
+
+		_, err = DecodeQueryResponse(responses[1])
+		assert.Equal(t, &QueryError{Message: "db is down"}, err)
+	}
+
+	// NotFound answers unmatched queries
+	m.NotFound = QueryFunc(func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		return nil, errors.New("no handler for " + q.Name)
+	})
+	assert.Nil(t, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "unknown"}))
+	assert.Len(t, responses, 3)
+}
+
+func TestQueryMux_Expired(t *testing.T) {
+	var responses [][]byte
+	now := time.Now()
+	m := testQueryMux(&responses, now.Add(-time.Millisecond), now)
+	called := false
+	m.HandleFunc("ping", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		called = true
+		return nil, nil
+	})
+
+	assert.Equal(t, ErrQueryExpired, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "ping"}))
+	assert.False(t, called, "expired queries are not served")
+	assert.Len(t, responses, 0)
+
+	// The deadline passes while the handler runs
+	deadline := now.Add(time.Second)
+	m.deadline = func(*serf.Query) time.Time { return deadline }
+	m.now = func() time.Time { return now }
+	m.HandleFunc("slow", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		now = now.Add(2 * time.Second)
+		return nil, nil
+	})
+	assert.Equal(t, ErrQueryExpired, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "slow"}))
+	assert.Len(t, responses, 0)
+
+	// Queries replayed from the journal have no deadline
+	m.deadline = (*serf.Query).Deadline
+	assert.Equal(t, ErrQueryExpired, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "ping"}))
+	assert.Len(t, responses, 0)
+}
+
+func TestQueryMux_NotRetried(t *testing.T) {
+	var responses [][]byte
+	now := time.Now()
+	m := testQueryMux(&responses, now.Add(time.Second), now)
+	m.respond = func(q *serf.Query, b []byte) error {
+		responses = append(responses, b)
+		return errors.New("Response already sent")
+	}
+	var calls int
+	m.HandleFunc("ping", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		calls++
+		return []byte("pong"), nil
+	})
+
+	h := SerfEventHandler{
+		QueryHandler: m,
+		Retry:        &RetryPolicy{MaxAttempts: 3},
+		Logger:       &log.NullLogger{},
+	}
+	assert.EqualError(t, h.HandleEventErr(context.Background(), &serf.Query{Name: "ping"}), "Response already sent")
+	assert.Equal(t, 1, calls)
+	assert.Len(t, responses, 1)
+
+	// Nor are expired queries
+	m.deadline = func(*serf.Query) time.Time { return now.Add(-time.Second) }
+	assert.Equal(t, ErrQueryExpired, h.HandleEventErr(context.Background(), &serf.Query{Name: "ping"}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestQueryMux_TooLarge(t *testing.T) {
+	var responses [][]byte
+	now := time.Now()
+	m := testQueryMux(&responses, now.Add(time.Second), now)
+	m.HandleFunc("dump", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		return bytes.Repeat([]byte("x"), serf.QueryResponseSizeLimit), nil
+	})
+
+	assert.Equal(t, ErrResponseTooLarge, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: "dump"}))
+	if assert.Len(t, responses, 1) {
+		_, err := DecodeQueryResponse(responses[0])
+		assert.Equal(t, &QueryError{Message: ErrResponseTooLarge.Error()}, err)
+	}
+}
+
+func TestQueryMux_MaxResponseSize(t *testing.T) {
+	var responses [][]byte
+	now := time.Now()
+	m := testQueryMux(&responses, now.Add(time.Second), now)
+	m.HandleFunc("dump/:size", func(ctx context.Context, q *serf.Query) ([]byte, error) {
+		size, _ := strconv.Atoi(ParamsFromContext(ctx).Get("size"))
+		return bytes.Repeat([]byte("x"), size), nil
+	})
+
+	// The encoded response has one more byte than the payload
+	fits := fmt.Sprintf("dump/%d", MaxQueryResponseSize-1)
+	assert.Nil(t, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: fits}))
+	tooLarge := fmt.Sprintf("dump/%d", MaxQueryResponseSize)
+	assert.Equal(t, ErrResponseTooLarge, m.HandleQueryEventErr(context.Background(), &serf.Query{Name: tooLarge}))
+
+	if assert.Len(t, responses, 2) {
+		assert.Len(t, responses[0], MaxQueryResponseSize)
+		_, err := DecodeQueryResponse(responses[1])
+		assert.Equal(t, &QueryError{Message: ErrResponseTooLarge.Error()}, err)
+	}
+}
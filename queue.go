@@ -0,0 +1,369 @@
+package serfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// OverflowPolicy determines what happens when an event arrives and the
+// event queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the source channel until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued event to make room for the new one.
+	OverflowDropOldest
+
+	// OverflowDropNewest drops the incoming event.
+	OverflowDropNewest
+
+	// OverflowDropByType drops events whose type is listed in Config.SheddableTypes.
+	// The incoming event is dropped if it is sheddable, otherwise the oldest queued
+	// sheddable event is dropped. If no event can be shed, the queue blocks.
+	OverflowDropByType
+
+	// OverflowCoalesce merges the incoming event with queued events it supersedes.
+	// Queued member events lose the members present in a newer member event and
+	// coalescable user events replace older ones with the same name. If the queue
+	// is still full afterwards, it blocks.
+	OverflowCoalesce
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropByType:
+		return "drop-by-type"
+	case OverflowCoalesce:
+		return "coalesce"
+	default:
+		return "unknown"
+	}
+}
+
+// OverflowHandler is notified of every event dropped from a full queue.
+type OverflowHandler interface {
+	HandleOverflow(serf.Event, OverflowPolicy)
+}
+
+// envelope carries a Serf event through the queue along with the values
+// recorded when it was received.
+type envelope struct {
+	event    serf.Event
+	received time.Time
+	source   *source
+
+	// ticket acknowledges the journal entry of the event once it is handled.
+	ticket *ticket
+
+	// replayed is true if the event was replayed from the journal.
+	replayed bool
+
+	// origin tracks the parts of the event once it is routed to the workers.
+	origin *origin
+
+	// task is run by the worker of the event instead of the source handler.
+	// Tasks are never dropped by the overflow policy.
+	task func(context.Context) error
+}
+
+// queue is a bounded FIFO of Serf events which applies an OverflowPolicy
+// when full.
+type queue struct {
+	mu       sync.Mutex
+	items    []envelope
+	size     int
+	policy   OverflowPolicy
+	shed     map[serf.EventType]bool
+	overflow OverflowHandler
+	dropped  func(envelope)
+	closed   bool
+	readyCh  chan struct{}
+	spaceCh  chan struct{}
+}
+
+func newQueue(size int, policy OverflowPolicy, shed []serf.EventType, overflow OverflowHandler) *queue {
+	if size < 1 {
+		size = 1
+	}
+	q := &queue{
+		size:     size,
+		policy:   policy,
+		shed:     make(map[serf.EventType]bool),
+		overflow: overflow,
+		readyCh:  make(chan struct{}, 1),
+		spaceCh:  make(chan struct{}, 1),
+	}
+	for _, t := range shed {
+		q.shed[t] = true
+	}
+	return q
+}
+
+// push adds an event to the queue, applying the overflow policy if the
+// queue is full. It returns false if done was closed while blocked.
+func (q *queue) push(e envelope, done <-chan struct{}) bool {
+	for {
+		q.mu.Lock()
+		var dropped []envelope
+		accepted := len(q.items) < q.size
+		if accepted {
+			q.items = append(q.items, e)
+		} else {
+			dropped, accepted = q.makeRoom(e)
+		}
+		space := len(q.items) < q.size
+		q.mu.Unlock()
+
+		for _, d := range dropped {
+			q.report(d)
+		}
+		if accepted {
+			signal(q.readyCh)
+			if space {
+				signal(q.spaceCh)
+			}
+			return true
+		}
+
+		select {
+		case <-q.spaceCh:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// insert adds a task to the queue without applying the overflow policy. It
+// returns false if the queue is closed.
+func (q *queue) insert(e envelope) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.items = append(q.items, e)
+	q.mu.Unlock()
+
+	signal(q.readyCh)
+	return true
+}
+
+// pop removes the oldest event from the queue, blocking until one is
+// available. It returns false if done was closed while waiting or if the
+// queue is closed and empty.
+func (q *queue) pop(done <-chan struct{}) (envelope, bool) {
+	for {
+		if e, ok := q.tryPop(); ok {
+			return e, true
+		}
+		if q.isClosed() {
+			return envelope{}, false
+		}
+
+		select {
+		case <-q.readyCh:
+		case <-done:
+			return envelope{}, false
+		}
+	}
+}
+
+// tryPop removes the oldest event from the queue without blocking.
+func (q *queue) tryPop() (envelope, bool) {
+	q.mu.Lock()
+	if len(q.items) == 0 {
+		q.mu.Unlock()
+		return envelope{}, false
+	}
+	e := q.items[0]
+	q.items[0] = envelope{}
+	q.items = q.items[1:]
+	more := len(q.items) > 0
+	q.mu.Unlock()
+
+	signal(q.spaceCh)
+	if more {
+		signal(q.readyCh)
+	}
+	return e, true
+}
+
+// resize changes the capacity of the queue. Events above a reduced capacity
+// are kept, but new events are subject to the overflow policy until the
+// queue shrinks below it.
+func (q *queue) resize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	q.mu.Lock()
+	q.size = size
+	space := len(q.items) < q.size
+	q.mu.Unlock()
+
+	if space {
+		signal(q.spaceCh)
+	}
+}
+
+// close marks the queue as closed. No more events may be pushed, and pop
+// returns false once the remaining events have been removed.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	signal(q.readyCh)
+}
+
+// isClosed returns true if the queue has been closed.
+func (q *queue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// len returns the number of queued events.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// makeRoom applies the overflow policy to a full queue. It returns the
+// events which were dropped and whether the incoming event was handled.
+// It must be called with the lock held.
+func (q *queue) makeRoom(e envelope) ([]envelope, bool) {
+	switch q.policy {
+	case OverflowDropOldest:
+		for i, item := range q.items {
+			if item.task == nil {
+				q.remove(i)
+				q.items = append(q.items, e)
+				return []envelope{item}, true
+			}
+		}
+
+	case OverflowDropNewest:
+		return []envelope{e}, true
+
+	case OverflowDropByType:
+		if q.sheddable(e) {
+			return []envelope{e}, true
+		}
+		for i, item := range q.items {
+			if q.sheddable(item) {
+				q.remove(i)
+				q.items = append(q.items, e)
+				return []envelope{item}, true
+			}
+		}
+
+	case OverflowCoalesce:
+		dropped := q.coalesce(e)
+		if len(q.items) < q.size {
+			q.items = append(q.items, e)
+			return dropped, true
+		}
+		return dropped, false
+	}
+	return nil, false
+}
+
+// coalesce removes the parts of queued events from the same source which are
+// superseded by e.
+// It must be called with the lock held.
+func (q *queue) coalesce(e envelope) []envelope {
+	var dropped []envelope
+	switch evt := e.event.(type) {
+	case serf.MemberEvent:
+		names := make(map[string]bool, len(evt.Members))
+		for _, m := range evt.Members {
+			names[m.Name] = true
+		}
+
+		for i := 0; i < len(q.items); i++ {
+			item := q.items[i]
+			me, ok := item.event.(serf.MemberEvent)
+			if !ok || item.source != e.source || item.task != nil {
+				continue
+			}
+
+			var kept, removed []serf.Member
+			for _, m := range me.Members {
+				if names[m.Name] {
+					removed = append(removed, m)
+				} else {
+					kept = append(kept, m)
+				}
+			}
+			if len(removed) == 0 {
+				continue
+			}
+
+			item.event = serf.MemberEvent{Type: me.Type, Members: removed}
+			if len(kept) == 0 {
+				q.remove(i)
+				i--
+			} else {
+				// The queued remainder acknowledges the journal entry
+				q.items[i].event = serf.MemberEvent{Type: me.Type, Members: kept}
+				item.ticket = nil
+			}
+			dropped = append(dropped, item)
+		}
+
+	case serf.UserEvent:
+		if !evt.Coalesce {
+			break
+		}
+		for i := 0; i < len(q.items); i++ {
+			ue, ok := q.items[i].event.(serf.UserEvent)
+			if ok && q.items[i].source == e.source && ue.Coalesce && ue.Name == evt.Name && ue.LTime <= evt.LTime {
+				dropped = append(dropped, q.items[i])
+				q.remove(i)
+				i--
+			}
+		}
+	}
+	return dropped
+}
+
+// remove deletes the item at index i. It must be called with the lock held.
+func (q *queue) remove(i int) {
+	copy(q.items[i:], q.items[i+1:])
+	q.items[len(q.items)-1] = envelope{}
+	q.items = q.items[:len(q.items)-1]
+}
+
+// sheddable returns true if the event may be dropped by OverflowDropByType.
+func (q *queue) sheddable(e envelope) bool {
+	return e.event != nil && e.task == nil && q.shed[e.event.EventType()]
+}
+
+// report notifies the OverflowHandler of a dropped event.
+func (q *queue) report(e envelope) {
+	if q.overflow != nil {
+		q.overflow.HandleOverflow(e.event, q.policy)
+	}
+	if q.dropped != nil {
+		q.dropped(e)
+	}
+}
+
+// signal performs a non-blocking send on a notification channel.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
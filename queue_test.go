@@ -0,0 +1,177 @@
+package serfer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+)
+
+// overflowRecorder records dropped events.
+type overflowRecorder struct {
+	sync.Mutex
+	dropped []serf.Event
+}
+
+func (o *overflowRecorder) HandleOverflow(e serf.Event, p OverflowPolicy) {
+	o.Lock()
+	o.dropped = append(o.dropped, e)
+	o.Unlock()
+}
+
+func (o *overflowRecorder) events() []serf.Event {
+	o.Lock()
+	defer o.Unlock()
+	return append([]serf.Event(nil), o.dropped...)
+}
+
+func userEvent(name string, ltime int, coalesce bool) serf.UserEvent {
+	return serf.UserEvent{LTime: serf.LamportTime(ltime), Name: name, Coalesce: coalesce}
+}
+
+func drain(q *queue) []serf.Event {
+	var out []serf.Event
+	for {
+		e, ok := q.tryPop()
+		if !ok {
+			return out
+		}
+		out = append(out, e.event)
+	}
+}
+
+func TestQueue_Block(t *testing.T) {
+	q := newQueue(1, OverflowBlock, nil, nil)
+	done := make(chan struct{})
+	assert.True(t, q.push(envelope{event: userEvent("a", 1, false)}, done))
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(envelope{event: userEvent("b", 2, false)}, done)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push should block while the queue is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	e, ok := q.pop(done)
+	assert.True(t, ok)
+	assert.Equal(t, "a", e.event.(serf.UserEvent).Name)
+	assert.True(t, <-pushed)
+
+	// Blocked pushes are abandoned when done is closed
+	go func() {
+		pushed <- q.push(envelope{event: userEvent("c", 3, false)}, done)
+	}()
+	close(done)
+	assert.False(t, <-pushed)
+}
+
+func TestQueue_DropOldest(t *testing.T) {
+	rec := &overflowRecorder{}
+	q := newQueue(2, OverflowDropOldest, nil, rec)
+	for i, n := range []string{"a", "b", "c"} {
+		q.push(envelope{event: userEvent(n, i, false)}, nil)
+	}
+
+	assert.Equal(t, []serf.Event{userEvent("b", 1, false), userEvent("c", 2, false)}, drain(q))
+	assert.Equal(t, []serf.Event{userEvent("a", 0, false)}, rec.events())
+}
+
+func TestQueue_DropNewest(t *testing.T) {
+	rec := &overflowRecorder{}
+	q := newQueue(2, OverflowDropNewest, nil, rec)
+	for i, n := range []string{"a", "b", "c"} {
+		q.push(envelope{event: userEvent(n, i, false)}, nil)
+	}
+
+	assert.Equal(t, []serf.Event{userEvent("a", 0, false), userEvent("b", 1, false)}, drain(q))
+	assert.Equal(t, []serf.Event{userEvent("c", 2, false)}, rec.events())
+}
+
+func TestQueue_DropByType(t *testing.T) {
+	rec := &overflowRecorder{}
+	q := newQueue(2, OverflowDropByType, []serf.EventType{serf.EventUser}, rec)
+	join := memberEvent(serf.EventMemberJoin, "a")
+	fail := memberEvent(serf.EventMemberFailed, "a")
+
+	q.push(envelope{event: userEvent("u", 1, false)}, nil)
+	q.push(envelope{event: join}, nil)
+
+	// A member event sheds the queued user event
+	q.push(envelope{event: fail}, nil)
+
+	// A user event is shed itself
+	q.push(envelope{event: userEvent("v", 2, false)}, nil)
+
+	assert.Equal(t, []serf.Event{join, fail}, drain(q))
+	assert.Equal(t, []serf.Event{userEvent("u", 1, false), userEvent("v", 2, false)}, rec.events())
+}
+
+func TestQueue_Coalesce(t *testing.T) {
+	rec := &overflowRecorder{}
+	q := newQueue(2, OverflowCoalesce, nil, rec)
+
+	q.push(envelope{event: memberEvent(serf.EventMemberJoin, "a")}, nil)
+	q.push(envelope{event: userEvent("deploy", 1, true)}, nil)
+
+	// Supersedes the queued join
+	q.push(envelope{event: memberEvent(serf.EventMemberFailed, "a")}, nil)
+	assert.Equal(t, []serf.Event{memberEvent(serf.EventMemberJoin, "a")}, rec.events())
+
+	// Replaces the queued coalescable user event
+	q.push(envelope{event: userEvent("deploy", 2, true)}, nil)
+
+	assert.Equal(t, []serf.Event{
+		memberEvent(serf.EventMemberFailed, "a"),
+		userEvent("deploy", 2, true),
+	}, drain(q))
+	assert.Len(t, rec.events(), 2)
+}
+
+func TestQueue_CoalescePartialMemberEvent(t *testing.T) {
+	q := newQueue(2, OverflowCoalesce, nil, nil)
+	q.push(envelope{event: memberEvent(serf.EventMemberJoin, "a", "b")}, nil)
+	q.push(envelope{event: userEvent("deploy", 1, false)}, nil)
+
+	q.mu.Lock()
+	dropped := q.coalesce(envelope{event: memberEvent(serf.EventMemberFailed, "a")})
+	q.mu.Unlock()
+
+	assert.Equal(t, []envelope{{event: memberEvent(serf.EventMemberJoin, "a")}}, dropped)
+	assert.Equal(t, []serf.Event{
+		memberEvent(serf.EventMemberJoin, "b"),
+		userEvent("deploy", 1, false),
+	}, drain(q))
+}
+
+func TestSerfer_OverflowPolicy(t *testing.T) {
+	rec := &overflowRecorder{}
+	release := make(chan struct{})
+	handler := &recordingHandler{block: map[string]chan struct{}{"a": release}}
+
+	conf := DefaultConfig()
+	conf.QueueSize = 1
+	conf.OverflowPolicy = OverflowDropNewest
+	conf.OverflowHandler = rec
+
+	ch := make(chan serf.Event)
+	s := NewSerferConfig(ch, handler, conf)
+	s.Start()
+
+	// The first event blocks the worker, the rest fill the worker buffer
+	// and the queue until events are dropped.
+	for i := 0; i < workerBufferSize+10; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a")
+	}
+	waitFor(t, func() bool {
+		return len(rec.events()) > 0
+	})
+
+	close(release)
+	assert.Nil(t, s.Stop())
+}
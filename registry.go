@@ -0,0 +1,325 @@
+package serfer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// ErrUnknownSubscription is returned when a subscription is not registered.
+var ErrUnknownSubscription = errors.New("serfer: unknown subscription")
+
+// Subscription is a handle to a handler registered with a Registry.
+type Subscription struct {
+	kind     HandlerKind
+	handler  interface{}
+	registry *Registry
+}
+
+// Kind returns the kind of events the subscription receives.
+func (s *Subscription) Kind() HandlerKind {
+	return s.kind
+}
+
+// Unregister removes the subscription from its Registry.
+func (s *Subscription) Unregister() error {
+	return s.registry.Unregister(s)
+}
+
+// Registry is an EventHandler whose handlers can be registered and removed
+// while events are being processed. Every event is dispatched with the set of
+// handlers registered when it started, so changes take effect atomically
+// between events. Events already being handled finish with the old handlers.
+type Registry struct {
+	mu   sync.Mutex
+	base SerfEventHandler
+	mode FanOutMode
+	subs []*Subscription
+
+	// current holds the SerfEventHandler built from base and subs.
+	current atomic.Value
+}
+
+// NewRegistry returns a Registry which dispatches events with the given
+// SerfEventHandler. Handlers already set on it are called before registered
+// ones, and handlers registered for the same kind are called with the given mode.
+func NewRegistry(base SerfEventHandler, mode FanOutMode) *Registry {
+	r := &Registry{base: base, mode: mode}
+	r.current.Store(base)
+	return r
+}
+
+// Register adds a handler for the given kind of event. The handler must
+// implement the interface of the kind, such as MemberJoinHandler for
+// KindMemberJoin or Reconciler for KindReconcile. The handlers of trackers,
+// such as KindFlap, cannot be registered.
+func (r *Registry) Register(kind HandlerKind, handler interface{}) (*Subscription, error) {
+	if err := checkHandler(kind, handler); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub := &Subscription{kind: kind, handler: handler, registry: r}
+	r.subs = append(r.subs, sub)
+	r.rebuild()
+	return sub, nil
+}
+
+// RegisterSelector adds a member event handler or a Reconciler which only
+// receives the members matching a selector. See Selector for its syntax.
+func (r *Registry) RegisterSelector(kind HandlerKind, selector string, handler interface{}) (*Subscription, error) {
+	switch kind {
+	case KindMemberJoin, KindMemberLeave, KindMemberFailed, KindMemberUpdate, KindMemberReap, KindReconcile:
+	default:
+		return nil, fmt.Errorf("serfer: %s events cannot be selected by member tags", kind)
+	}
+	if err := checkHandler(kind, handler); err != nil {
+		return nil, err
+	}
+
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return r.Register(kind, MemberFilter{Selector: sel, Handler: handler})
+}
+
+// Unregister removes a subscription.
+func (r *Registry) Unregister(sub *Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, s := range r.subs {
+		if s == sub {
+			r.subs = append(r.subs[:i], r.subs[i+1:]...)
+			r.rebuild()
+			return nil
+		}
+	}
+	return ErrUnknownSubscription
+}
+
+// Replace swaps the handler of a subscription, keeping its position among
+// the handlers of its kind.
+func (r *Registry) Replace(sub *Subscription, handler interface{}) error {
+	if err := checkHandler(sub.kind, handler); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.subs {
+		if s == sub {
+			s.handler = handler
+			r.rebuild()
+			return nil
+		}
+	}
+	return ErrUnknownSubscription
+}
+
+// HandleEvent dispatches an event to the registered handlers.
+func (r *Registry) HandleEvent(e serf.Event) {
+	r.HandleEventErr(context.Background(), e)
+}
+
+// HandleEventContext dispatches an event to the registered handlers with a context.
+func (r *Registry) HandleEventContext(ctx context.Context, e serf.Event) {
+	r.HandleEventErr(ctx, e)
+}
+
+// HandleEventErr dispatches an event to the registered handlers with a context
+// and returns the first error of a handler which failed.
+func (r *Registry) HandleEventErr(ctx context.Context, e serf.Event) error {
+	h := r.current.Load().(SerfEventHandler)
+	return h.HandleEventErr(ctx, e)
+}
+
+// rebuild stores a new SerfEventHandler with the registered handlers. It must
+// be called with the lock held.
+func (r *Registry) rebuild() {
+	h := r.base
+	for kind, f := range handlerFields {
+		var list []interface{}
+		if base := f.get(&h); base != nil {
+			list = append(list, base)
+		}
+		for _, s := range r.subs {
+			if s.kind == kind {
+				list = append(list, s.handler)
+			}
+		}
+
+		if len(list) == 1 {
+			f.set(&h, list[0])
+		} else if len(list) > 1 {
+			f.set(&h, f.fan(r.mode, list))
+		}
+	}
+
+	r.current.Store(h)
+}
+
+// handlerField accesses the field of a SerfEventHandler which holds the
+// handler of a kind.
+type handlerField struct {
+
+	// accepts returns true if a handler implements the interface of the kind.
+	accepts func(interface{}) bool
+
+	// get returns the handler of the field, or nil.
+	get func(*SerfEventHandler) interface{}
+
+	// set replaces the handler of the field.
+	set func(*SerfEventHandler, interface{})
+
+	// fan returns a fan-out type calling the given handlers.
+	fan func(FanOutMode, []interface{}) interface{}
+}
+
+// handlerFields are the fields of a SerfEventHandler, by kind.
+var handlerFields = map[HandlerKind]handlerField{
+	KindMemberJoin: {
+		accepts: func(h interface{}) bool { _, ok := h.(MemberJoinHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.NodeJoined },
+		set:     func(s *SerfEventHandler, h interface{}) { s.NodeJoined = h.(MemberJoinHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := MemberJoinHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(MemberJoinHandler))
+			}
+			return fan
+		},
+	},
+	KindMemberLeave: {
+		accepts: func(h interface{}) bool { _, ok := h.(MemberLeaveHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.NodeLeft },
+		set:     func(s *SerfEventHandler, h interface{}) { s.NodeLeft = h.(MemberLeaveHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := MemberLeaveHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(MemberLeaveHandler))
+			}
+			return fan
+		},
+	},
+	KindMemberFailed: {
+		accepts: func(h interface{}) bool { _, ok := h.(MemberFailureHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.NodeFailed },
+		set:     func(s *SerfEventHandler, h interface{}) { s.NodeFailed = h.(MemberFailureHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := MemberFailureHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(MemberFailureHandler))
+			}
+			return fan
+		},
+	},
+	KindMemberUpdate: {
+		accepts: func(h interface{}) bool { _, ok := h.(MemberUpdateHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.NodeUpdated },
+		set:     func(s *SerfEventHandler, h interface{}) { s.NodeUpdated = h.(MemberUpdateHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := MemberUpdateHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(MemberUpdateHandler))
+			}
+			return fan
+		},
+	},
+	KindMemberReap: {
+		accepts: func(h interface{}) bool { _, ok := h.(MemberReapHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.NodeReaped },
+		set:     func(s *SerfEventHandler, h interface{}) { s.NodeReaped = h.(MemberReapHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := MemberReapHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(MemberReapHandler))
+			}
+			return fan
+		},
+	},
+	KindUserEvent: {
+		accepts: func(h interface{}) bool { _, ok := h.(UserEventHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.UserEvent },
+		set:     func(s *SerfEventHandler, h interface{}) { s.UserEvent = h.(UserEventHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := UserEventHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(UserEventHandler))
+			}
+			return fan
+		},
+	},
+	KindUnknownEvent: {
+		accepts: func(h interface{}) bool { _, ok := h.(UnknownEventHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.UnknownEventHandler },
+		set:     func(s *SerfEventHandler, h interface{}) { s.UnknownEventHandler = h.(UnknownEventHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := UnknownEventHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(UnknownEventHandler))
+			}
+			return fan
+		},
+	},
+	KindLeaderElection: {
+		accepts: func(h interface{}) bool { _, ok := h.(LeaderElectionHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.LeaderElectionHandler },
+		set:     func(s *SerfEventHandler, h interface{}) { s.LeaderElectionHandler = h.(LeaderElectionHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := LeaderElectionHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(LeaderElectionHandler))
+			}
+			return fan
+		},
+	},
+	KindQuery: {
+		accepts: func(h interface{}) bool { _, ok := h.(QueryEventHandler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.QueryHandler },
+		set:     func(s *SerfEventHandler, h interface{}) { s.QueryHandler = h.(QueryEventHandler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := QueryEventHandlers{Mode: mode}
+			for _, h := range list {
+				fan.Handlers = append(fan.Handlers, h.(QueryEventHandler))
+			}
+			return fan
+		},
+	},
+	KindReconcile: {
+		accepts: func(h interface{}) bool { _, ok := h.(Reconciler); return ok },
+		get:     func(s *SerfEventHandler) interface{} { return s.Reconciler },
+		set:     func(s *SerfEventHandler, h interface{}) { s.Reconciler = h.(Reconciler) },
+		fan: func(mode FanOutMode, list []interface{}) interface{} {
+			fan := Reconcilers{Mode: mode}
+			for _, h := range list {
+				fan.Reconcilers = append(fan.Reconcilers, h.(Reconciler))
+			}
+			return fan
+		},
+	},
+}
+
+// checkHandler verifies that a handler implements the interface of its kind.
+func checkHandler(kind HandlerKind, handler interface{}) error {
+	f, ok := handlerFields[kind]
+	switch {
+	case ok:
+	case kind == KindTransition || kind == KindRecovered || kind == KindRejoined || kind == KindTags || kind == KindFlap:
+		return fmt.Errorf("serfer: %s handlers are set on their tracker, not by kind", kind)
+	default:
+		return fmt.Errorf("serfer: unknown handler kind %q", kind)
+	}
+	if !f.accepts(handler) {
+		return fmt.Errorf("serfer: %T does not handle %s events", handler, kind)
+	}
+	return nil
+}
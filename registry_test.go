@@ -0,0 +1,114 @@
+package serfer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func registryBase() SerfEventHandler {
+	return SerfEventHandler{
+		IsLeader: func() bool {
+			return true
+		},
+		IsLeaderEvent: func(string) bool {
+			return false
+		},
+		Logger: &log.NullLogger{},
+	}
+}
+
+func TestRegistry_RegisterUnregister(t *testing.T) {
+	var order []string
+	base := registryBase()
+	base.NodeJoined = &joinRecorder{name: "base", order: &order}
+	r := NewRegistry(base, FanOutSequential)
+	evt := memberEvent(serf.EventMemberJoin, "a")
+
+	first, err := r.Register(KindMemberJoin, &joinRecorder{name: "first", order: &order})
+	assert.Nil(t, err)
+	assert.Equal(t, KindMemberJoin, first.Kind())
+	second, err := r.Register(KindMemberJoin, &joinRecorder{name: "second", order: &order})
+	assert.Nil(t, err)
+
+	r.HandleEvent(evt)
+	assert.Equal(t, []string{"base", "first", "second"}, order)
+
+	// Replace keeps the position of the subscription
+	order = nil
+	assert.Nil(t, r.Replace(first, &joinRecorder{name: "replaced", order: &order}))
+	r.HandleEvent(evt)
+	assert.Equal(t, []string{"base", "replaced", "second"}, order)
+
+	order = nil
+	assert.Nil(t, first.Unregister())
+	assert.Equal(t, ErrUnknownSubscription, first.Unregister())
+	assert.Equal(t, ErrUnknownSubscription, r.Replace(first, base.NodeJoined))
+	r.HandleEvent(evt)
+	assert.Equal(t, []string{"base", "second"}, order)
+
+	order = nil
+	assert.Nil(t, r.Unregister(second))
+	r.HandleEvent(evt)
+	assert.Equal(t, []string{"base"}, order)
+}
+
+func TestRegistry_InvalidHandler(t *testing.T) {
+	r := NewRegistry(registryBase(), FanOutSequential)
+
+	_, err := r.Register(KindReconcile, &joinRecorder{})
+	assert.EqualError(t, err, "serfer: *serfer.joinRecorder does not handle reconcile events")
+
+	_, err = r.Register(HandlerKind("bogus"), &joinRecorder{})
+	assert.EqualError(t, err, `serfer: unknown handler kind "bogus"`)
+
+	_, err = r.Register(KindFlap, &flapRecorder{})
+	assert.EqualError(t, err, "serfer: flap handlers are set on their tracker, not by kind")
+
+	sub, err := r.Register(KindMemberJoin, &joinRecorder{})
+	assert.Nil(t, err)
+	assert.NotNil(t, r.Replace(sub, &MockEvent{}))
+}
+
+func TestRegistry_ConcurrentChanges(t *testing.T) {
+	var based, stable, churned []string
+	base := registryBase()
+	base.NodeJoined = &joinRecorder{name: "base", order: &based}
+	r := NewRegistry(base, FanOutParallel)
+	_, err := r.Register(KindMemberJoin, &joinRecorder{name: "stable", order: &stable})
+	assert.Nil(t, err)
+
+	ch := make(chan serf.Event)
+	s := NewSerfer(ch, r, 4)
+	s.Start()
+
+	// The same recorder is registered every time so that its lock guards churned
+	churner := &joinRecorder{name: "churned", order: &churned}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			sub, _ := r.Register(KindMemberJoin, churner)
+			sub.Unregister()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a")
+	}
+	wg.Wait()
+	n, err := s.StopWithTimeout(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	assert.Len(t, based, 100)
+	assert.Len(t, stable, 100)
+	churner.Lock()
+	defer churner.Unlock()
+	assert.True(t, len(churned) <= 100, "each event is handled once by the handlers registered when it started")
+}
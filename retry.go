@@ -0,0 +1,260 @@
+package serfer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// HandlerKind identifies the handler an event was dispatched to. It labels
+// metrics and failures, and selects the handler set by WithHandler or
+// Registry.Register.
+type HandlerKind string
+
+const (
+	// KindMemberJoin is the MemberJoinHandler, NodeJoined.
+	KindMemberJoin HandlerKind = "member-join"
+
+	// KindMemberLeave is the MemberLeaveHandler, NodeLeft.
+	KindMemberLeave HandlerKind = "member-leave"
+
+	// KindMemberFailed is the MemberFailureHandler, NodeFailed.
+	KindMemberFailed HandlerKind = "member-failed"
+
+	// KindMemberUpdate is the MemberUpdateHandler, NodeUpdated.
+	KindMemberUpdate HandlerKind = "member-update"
+
+	// KindMemberReap is the MemberReapHandler, NodeReaped.
+	KindMemberReap HandlerKind = "member-reap"
+
+	// KindUserEvent is the UserEventHandler of the service or of a namespace.
+	KindUserEvent HandlerKind = "user"
+
+	// KindUnknownEvent is the UnknownEventHandler of the service or of a namespace.
+	KindUnknownEvent HandlerKind = "unknown"
+
+	// KindLeaderElection is the LeaderElectionHandler of the service or of a namespace.
+	KindLeaderElection HandlerKind = "leader-election"
+
+	// KindQuery is the QueryEventHandler, QueryHandler.
+	KindQuery HandlerKind = "query"
+
+	// KindReconcile is the Reconciler.
+	KindReconcile HandlerKind = "reconcile"
+
+	// KindTransition is the NodeTransitioned TransitionHandler. Like the
+	// kinds below, it only labels metrics and failures: transition handlers
+	// are set with WithStatusTracking and cannot be passed to WithHandler or
+	// Registry.Register.
+	KindTransition HandlerKind = "transition"
+
+	// KindRecovered is the NodeRecovered TransitionHandler.
+	KindRecovered HandlerKind = "recovered"
+
+	// KindRejoined is the NodeRejoined TransitionHandler.
+	KindRejoined HandlerKind = "rejoined"
+
+	// KindTags is the handler of the TagTracker, set with WithTagTracker.
+	KindTags HandlerKind = "tags"
+
+	// KindFlap is the handler of the FlapDetector, set with WithFlapDetector.
+	KindFlap HandlerKind = "flap"
+)
+
+// RetryPolicy determines how failed handlers are retried with exponential backoff.
+type RetryPolicy struct {
+
+	// MaxAttempts is the maximum number of times a handler is called for an
+	// event, including the first attempt.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+
+	// Multiplier is applied to the delay after every retry. It must be at
+	// least 1; SerfEventHandler.Validate rejects smaller values, which are
+	// otherwise treated as 1, keeping the delay constant.
+	Multiplier float64
+
+	// Jitter randomizes each delay by up to the given fraction in either
+	// direction. A Jitter of 0.2 yields delays between 80% and 120% of the
+	// computed backoff. It must be between 0 and 1.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns a RetryPolicy which makes up to five attempts,
+// starting with a 100ms delay that doubles up to 5s, with 20% jitter.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (r *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	d := float64(r.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		d *= multiplier
+		if r.MaxBackoff > 0 && d > float64(r.MaxBackoff) {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && d > float64(r.MaxBackoff) {
+		d = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d += d * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Failure describes a handler which failed and will not be retried.
+type Failure struct {
+
+	// Kind is the handler which failed.
+	Kind HandlerKind
+
+	// Event is the event being handled. For reconciliation it only contains
+	// the member which failed to reconcile.
+	Event serf.Event
+
+	// Err is the error returned by the last attempt.
+	Err error
+
+	// Attempts is the number of times the handler was called.
+	Attempts int
+}
+
+// FailureHandler is called when a handler fails after exhausting its retries.
+type FailureHandler interface {
+	HandleFailure(Failure)
+}
+
+// try calls fn until it succeeds, the retry policy is exhausted or the context
+// is done. Terminal failures are reported to the FailureHandler. When fn fans
+// the event out to several handlers, each failed handler is retried on its own
+// instead of fn as a whole.
+func (s *SerfEventHandler) try(ctx context.Context, kind HandlerKind, e serf.Event, fn func(context.Context) error) error {
+	invoked(ctx, kind)
+	defer metrics.MeasureSince(metricsKey(s.MetricsPrefix, "handler", string(kind)), time.Now())
+
+	r := &retrier{s: s, kind: kind}
+	ctx = withRetrier(ctx, r)
+
+	var attempts int
+	var err error
+	for {
+		attempts++
+		if err = fn(ctx); err == nil {
+			metrics.IncrCounter(metricsKey(s.MetricsPrefix, "handler", string(kind), outcomeSuccess), 1)
+			return nil
+		}
+		if n, ok := r.fannedOut(); ok {
+			attempts = n
+			break
+		}
+		if !s.shouldRetry(ctx, attempts, err) {
+			break
+		}
+		metrics.IncrCounter(metricsKey(s.MetricsPrefix, "handler", string(kind), outcomeRetry), 1)
+	}
+
+	metrics.IncrCounter(metricsKey(s.MetricsPrefix, "handler", string(kind), outcomeFailure), 1)
+	s.Logger.Warn("serfer: handler failed", "kind", kind, "event", e, "attempts", attempts, "err", err)
+	if s.FailureHandler != nil {
+		s.FailureHandler.HandleFailure(Failure{Kind: kind, Event: e, Err: err, Attempts: attempts})
+	}
+	return err
+}
+
+// retrier retries the handlers of a fan-out on behalf of try, so that the
+// handlers which succeeded are not called again.
+type retrier struct {
+	s    *SerfEventHandler
+	kind HandlerKind
+
+	mu       sync.Mutex
+	used     bool
+	attempts int
+}
+
+// retry calls fn until it succeeds, the retry policy is exhausted or the
+// context is done.
+func (r *retrier) retry(ctx context.Context, fn func() error) error {
+	var attempts int
+	for {
+		attempts++
+		err := fn()
+		if err == nil || !r.s.shouldRetry(ctx, attempts, err) {
+			r.mu.Lock()
+			r.used = true
+			if err != nil && attempts > r.attempts {
+				r.attempts = attempts
+			}
+			r.mu.Unlock()
+			return err
+		}
+		metrics.IncrCounter(metricsKey(r.s.MetricsPrefix, "handler", string(r.kind), outcomeRetry), 1)
+	}
+}
+
+// fannedOut returns the largest number of attempts made by a failed handler
+// of a fan-out, and false if the handlers were not retried by a fan-out.
+func (r *retrier) fannedOut() (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts, r.used
+}
+
+// shouldRetry waits for the backoff after a failed attempt. It returns false
+// if the error is permanent, the retry policy is exhausted or the context is
+// done.
+func (s *SerfEventHandler) shouldRetry(ctx context.Context, attempts int, err error) bool {
+	if s.Retry == nil || attempts >= s.Retry.MaxAttempts || ctx.Err() != nil {
+		return false
+	}
+	if p, ok := err.(permanent); ok && p.Permanent() {
+		return false
+	}
+
+	timer := time.NewTimer(s.Retry.backoff(attempts))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// permanent is implemented by errors which retrying a handler cannot fix.
+type permanent interface {
+	Permanent() bool
+}
+
+// permanentError marks an error as permanent.
+type permanentError struct {
+	error
+}
+
+// Permanent returns true.
+func (permanentError) Permanent() bool {
+	return true
+}
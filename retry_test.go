@@ -0,0 +1,148 @@
+package serfer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// flakyReconciler fails until it has been called failures times.
+type flakyReconciler struct {
+	failures int
+	calls    int
+}
+
+func (f *flakyReconciler) Reconcile(m serf.Member) {
+	panic("ReconcileErr should be preferred")
+}
+
+func (f *flakyReconciler) ReconcileErr(ctx context.Context, m serf.Member) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("store unavailable")
+	}
+	return nil
+}
+
+// failures records terminal failures.
+type failures []Failure
+
+func (f *failures) HandleFailure(failure Failure) {
+	*f = append(*f, failure)
+}
+
+func retryHandler(r Reconciler, f FailureHandler) SerfEventHandler {
+	return SerfEventHandler{
+		ReconcileOnJoin: true,
+		Reconciler:      r,
+		IsLeader: func() bool {
+			return true
+		},
+		Retry: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Multiplier:     2,
+		},
+		FailureHandler: f,
+		Logger:         &log.NullLogger{},
+	}
+}
+
+func TestRetry_Succeeds(t *testing.T) {
+	r := &flakyReconciler{failures: 2}
+	f := &failures{}
+	h := retryHandler(r, f)
+
+	err := h.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, r.calls)
+	assert.Empty(t, *f)
+}
+
+func TestRetry_Exhausted(t *testing.T) {
+	r := &flakyReconciler{failures: 10}
+	f := &failures{}
+	h := retryHandler(r, f)
+
+	err := h.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a"))
+	assert.EqualError(t, err, "store unavailable")
+	assert.Equal(t, 3, r.calls)
+	if assert.Len(t, *f, 1) {
+		assert.Equal(t, KindReconcile, (*f)[0].Kind)
+		assert.Equal(t, 3, (*f)[0].Attempts)
+		assert.Equal(t, memberEvent(serf.EventMemberJoin, "a"), (*f)[0].Event)
+	}
+}
+
+func TestRetry_FanOutRetriesFailedHandlers(t *testing.T) {
+	for _, mode := range []FanOutMode{FanOutSequential, FanOutParallel} {
+		flaky, stable, broken := &flakyReconciler{failures: 1}, &flakyReconciler{}, &flakyReconciler{failures: 10}
+		f := &failures{}
+		h := retryHandler(Reconcilers{Mode: mode, Reconcilers: []Reconciler{flaky, stable}}, f)
+
+		assert.Nil(t, h.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a")))
+		assert.Equal(t, 2, flaky.calls)
+		assert.Equal(t, 1, stable.calls, "handlers which succeeded are not called again")
+		assert.Empty(t, *f)
+
+		stable.calls = 0
+		h = retryHandler(Reconcilers{Mode: mode, Reconcilers: []Reconciler{stable, broken}}, f)
+		assert.NotNil(t, h.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a")))
+		assert.Equal(t, 1, stable.calls)
+		assert.Equal(t, 3, broken.calls)
+		if assert.Len(t, *f, 1) {
+			assert.Equal(t, 3, (*f)[0].Attempts)
+		}
+	}
+}
+
+func TestRetry_NoPolicy(t *testing.T) {
+	r := &flakyReconciler{failures: 10}
+	f := &failures{}
+	h := retryHandler(r, f)
+	h.Retry = nil
+
+	assert.NotNil(t, h.HandleEventErr(context.Background(), memberEvent(serf.EventMemberJoin, "a")))
+	assert.Equal(t, 1, r.calls)
+	assert.Len(t, *f, 1)
+}
+
+func TestRetry_Cancelled(t *testing.T) {
+	r := &flakyReconciler{failures: 10}
+	f := &failures{}
+	h := retryHandler(r, f)
+	h.Retry.InitialBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	assert.NotNil(t, h.HandleEventErr(ctx, memberEvent(serf.EventMemberJoin, "a")))
+	assert.Equal(t, 1, r.calls)
+	assert.Len(t, *f, 1)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	r := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	assert.Equal(t, 100*time.Millisecond, r.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, r.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, r.backoff(4))
+	assert.Equal(t, time.Second, r.backoff(10))
+
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := r.backoff(2)
+		assert.True(t, d >= 100*time.Millisecond && d <= 300*time.Millisecond, "%v out of range", d)
+	}
+
+	// Without a multiplier the delay stays constant
+	r = &RetryPolicy{InitialBackoff: 100 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, r.backoff(3))
+}
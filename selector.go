@@ -0,0 +1,404 @@
+package serfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// operator is the comparison of a selector requirement.
+type operator int
+
+const (
+	opEquals operator = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opNotExists
+	opMatches
+	opNotMatches
+)
+
+// requirement is a single condition on a member tag.
+type requirement struct {
+	key    string
+	op     operator
+	values map[string]bool
+	regexp *regexp.Regexp
+}
+
+// matches returns true if the tags satisfy the requirement.
+func (r requirement) matches(tags map[string]string) bool {
+	v, ok := tags[r.key]
+	switch r.op {
+	case opEquals, opIn:
+		return ok && r.values[v]
+	case opNotEquals, opNotIn:
+		return !ok || !r.values[v]
+	case opExists:
+		return ok
+	case opNotExists:
+		return !ok
+	case opMatches:
+		return ok && r.regexp.MatchString(v)
+	case opNotMatches:
+		return !ok || !r.regexp.MatchString(v)
+	}
+	return false
+}
+
+// setPattern matches the "key in (a, b)" and "key notin (a, b)" requirements.
+var setPattern = regexp.MustCompile(`^([^\s=!~(),]+)\s+(in|notin)\s*\((.*)\)$`)
+
+// Selector selects members by their tags. A selector is a comma separated list
+// of requirements which must all be satisfied:
+//
+//	role=server        the tag equals the value ("==" is accepted too)
+//	role!=server       the tag is missing or differs from the value
+//	dc in (east,west)  the tag is one of the values
+//	dc notin (west)    the tag is missing or none of the values
+//	leader             the tag is set
+//	!leader            the tag is not set
+//	version=~^1\.      the tag matches the regular expression
+//	version!~^0\.      the tag is missing or does not match the expression
+//
+// Commas inside parentheses, braces and brackets, as in version=~^1\.\d{1,3},
+// do not separate requirements, nor do commas escaped with a backslash.
+// Parentheses, braces and brackets must be balanced unless they are escaped.
+// The escaped characters of values and sets, as in role=a\,b, are unescaped
+// while regular expressions are left as they are. Sets must not have empty
+// values. An empty selector matches every member.
+type Selector struct {
+	raw  string
+	reqs []requirement
+}
+
+// ParseSelector parses a selector.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{raw: strings.TrimSpace(s)}
+	parts, err := splitRequirements(sel.raw)
+	if err != nil {
+		return nil, fmt.Errorf("serfer: invalid selector %q: %v", s, err)
+	}
+	for _, part := range parts {
+		r, err := parseRequirement(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("serfer: invalid selector %q: %v", s, err)
+		}
+		sel.reqs = append(sel.reqs, r)
+	}
+	return sel, nil
+}
+
+// MustParseSelector parses a selector and panics if it is invalid.
+func MustParseSelector(s string) *Selector {
+	sel, err := ParseSelector(s)
+	if err != nil {
+		panic(err)
+	}
+	return sel
+}
+
+// String returns the selector as it was parsed.
+func (s *Selector) String() string {
+	return s.raw
+}
+
+// Matches returns true if the member satisfies every requirement.
+func (s *Selector) Matches(m serf.Member) bool {
+	for _, r := range s.reqs {
+		if !r.matches(m.Tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns the members which match the selector.
+func (s *Selector) Filter(members []serf.Member) []serf.Member {
+	var matched []serf.Member
+	for _, m := range members {
+		if s.Matches(m) {
+			matched = append(matched, m)
+		}
+	}
+	return matched
+}
+
+// splitRequirements splits a selector on the commas outside of parentheses,
+// braces and brackets, so that sets and regular expressions such as a{1,3} or
+// [a,b] are kept whole. A backslash escapes the next character. It fails if
+// the parentheses, braces or brackets are not balanced.
+func splitRequirements(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var parts []string
+	var parens, braces, brackets, start int
+	var escaped bool
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case brackets > 0:
+			// Only the end of a character class is special inside it
+			if c == ']' {
+				brackets--
+			}
+		case c == '[':
+			brackets++
+		case c == ']':
+			return nil, fmt.Errorf("unbalanced %q", c)
+		case c == '{':
+			braces++
+		case c == '}':
+			if braces--; braces < 0 {
+				return nil, fmt.Errorf("unbalanced %q", c)
+			}
+		case c == '(':
+			parens++
+		case c == ')':
+			if parens--; parens < 0 {
+				return nil, fmt.Errorf("unbalanced %q", c)
+			}
+		case c == ',' && parens == 0 && braces == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if parens != 0 || braces != 0 || brackets != 0 {
+		return nil, errors.New("unclosed parenthesis, brace or bracket")
+	}
+	return append(parts, s[start:]), nil
+}
+
+// splitValues splits the values of a set on the commas which are not escaped
+// and unescapes them.
+func splitValues(s string) []string {
+	var values []string
+	var escaped bool
+	start := 0
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ',':
+			values = append(values, unescape(strings.TrimSpace(s[start:i])))
+			start = i + 1
+		}
+	}
+	return append(values, unescape(strings.TrimSpace(s[start:])))
+}
+
+// unescape removes the backslashes escaping the characters of a value.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var buf bytes.Buffer
+	var escaped bool
+	for _, c := range s {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+func parseRequirement(s string) (requirement, error) {
+	if m := setPattern.FindStringSubmatch(s); m != nil {
+		r := requirement{key: m[1], op: opIn, values: make(map[string]bool)}
+		if m[2] == "notin" {
+			r.op = opNotIn
+		}
+		for _, v := range splitValues(m[3]) {
+			if v == "" {
+				return requirement{}, fmt.Errorf("empty value in %q", s)
+			}
+			r.values[v] = true
+		}
+		return r, nil
+	}
+
+	if strings.HasPrefix(s, "!") && !strings.ContainsAny(s[1:], "=!~") {
+		key := strings.TrimSpace(s[1:])
+		return requirement{key: key, op: opNotExists}, validKey(key)
+	}
+
+	i := strings.IndexAny(s, "=!~")
+	if i < 0 {
+		return requirement{key: s, op: opExists}, validKey(s)
+	}
+
+	key, rest := strings.TrimSpace(s[:i]), s[i:]
+	if err := validKey(key); err != nil {
+		return requirement{}, err
+	}
+
+	var op operator
+	var value string
+	switch {
+	case strings.HasPrefix(rest, "=="):
+		op, value = opEquals, rest[2:]
+	case strings.HasPrefix(rest, "=~"):
+		op, value = opMatches, rest[2:]
+	case strings.HasPrefix(rest, "!="):
+		op, value = opNotEquals, rest[2:]
+	case strings.HasPrefix(rest, "!~"):
+		op, value = opNotMatches, rest[2:]
+	case strings.HasPrefix(rest, "="):
+		op, value = opEquals, rest[1:]
+	default:
+		return requirement{}, fmt.Errorf("unknown operator in %q", s)
+	}
+
+	value = strings.TrimSpace(value)
+	r := requirement{key: key, op: op}
+	if op == opMatches || op == opNotMatches {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return requirement{}, err
+		}
+		r.regexp = re
+	} else {
+		r.values = map[string]bool{unescape(value): true}
+	}
+	return r, nil
+}
+
+// validKey checks that a tag key is not empty and has no whitespace.
+func validKey(key string) error {
+	if key == "" || strings.ContainsAny(key, " \t(),") {
+		return fmt.Errorf("invalid tag key %q", key)
+	}
+	return nil
+}
+
+// MemberFilter wraps a member event handler or a Reconciler so that it only
+// receives the members matching a Selector. The handler is not called when no
+// member matches. MemberFilter implements every member handler interface and
+// the Reconciler interface, and ignores events which the wrapped handler does
+// not handle.
+type MemberFilter struct {
+	Selector *Selector
+	Handler  interface{}
+}
+
+// filter returns the event restricted to the matching members.
+func (f MemberFilter) filter(e serf.MemberEvent) (serf.MemberEvent, bool) {
+	members := f.Selector.Filter(e.Members)
+	if len(members) == 0 {
+		return e, false
+	}
+	if len(members) == len(e.Members) {
+		return e, true
+	}
+	return serf.MemberEvent{Type: e.Type, Members: members}, true
+}
+
+// HandleMemberEvent passes the matching members to a MemberEventHandler.
+func (f MemberFilter) HandleMemberEvent(e serf.MemberEvent) {
+	h, ok := f.Handler.(MemberEventHandler)
+	if me, match := f.filter(e); ok && match {
+		h.HandleMemberEvent(me)
+	}
+}
+
+// HandleMemberJoin passes the matching members to a MemberJoinHandler.
+func (f MemberFilter) HandleMemberJoin(e serf.MemberEvent) {
+	f.HandleMemberJoinErr(context.Background(), e)
+}
+
+// HandleMemberJoinErr passes the matching members to a MemberJoinHandler.
+func (f MemberFilter) HandleMemberJoinErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := f.Handler.(MemberJoinHandler)
+	if me, match := f.filter(e); ok && match {
+		return handleMemberJoin(ctx, h, me)
+	}
+	return nil
+}
+
+// HandleMemberUpdate passes the matching members to a MemberUpdateHandler.
+func (f MemberFilter) HandleMemberUpdate(e serf.MemberEvent) {
+	f.HandleMemberUpdateErr(context.Background(), e)
+}
+
+// HandleMemberUpdateErr passes the matching members to a MemberUpdateHandler.
+func (f MemberFilter) HandleMemberUpdateErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := f.Handler.(MemberUpdateHandler)
+	if me, match := f.filter(e); ok && match {
+		return handleMemberUpdate(ctx, h, me)
+	}
+	return nil
+}
+
+// HandleMemberLeave passes the matching members to a MemberLeaveHandler.
+func (f MemberFilter) HandleMemberLeave(e serf.MemberEvent) {
+	f.HandleMemberLeaveErr(context.Background(), e)
+}
+
+// HandleMemberLeaveErr passes the matching members to a MemberLeaveHandler.
+func (f MemberFilter) HandleMemberLeaveErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := f.Handler.(MemberLeaveHandler)
+	if me, match := f.filter(e); ok && match {
+		return handleMemberLeave(ctx, h, me)
+	}
+	return nil
+}
+
+// HandleMemberFailure passes the matching members to a MemberFailureHandler.
+func (f MemberFilter) HandleMemberFailure(e serf.MemberEvent) {
+	f.HandleMemberFailureErr(context.Background(), e)
+}
+
+// HandleMemberFailureErr passes the matching members to a MemberFailureHandler.
+func (f MemberFilter) HandleMemberFailureErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := f.Handler.(MemberFailureHandler)
+	if me, match := f.filter(e); ok && match {
+		return handleMemberFailure(ctx, h, me)
+	}
+	return nil
+}
+
+// HandleMemberReap passes the matching members to a MemberReapHandler.
+func (f MemberFilter) HandleMemberReap(e serf.MemberEvent) {
+	f.HandleMemberReapErr(context.Background(), e)
+}
+
+// HandleMemberReapErr passes the matching members to a MemberReapHandler.
+func (f MemberFilter) HandleMemberReapErr(ctx context.Context, e serf.MemberEvent) error {
+	h, ok := f.Handler.(MemberReapHandler)
+	if me, match := f.filter(e); ok && match {
+		return handleMemberReap(ctx, h, me)
+	}
+	return nil
+}
+
+// Reconcile passes a matching member to a Reconciler.
+func (f MemberFilter) Reconcile(m serf.Member) {
+	f.ReconcileErr(context.Background(), m)
+}
+
+// ReconcileErr passes a matching member to a Reconciler.
+func (f MemberFilter) ReconcileErr(ctx context.Context, m serf.Member) error {
+	h, ok := f.Handler.(Reconciler)
+	if ok && f.Selector.Matches(m) {
+		return reconcileMember(ctx, h, m)
+	}
+	return nil
+}
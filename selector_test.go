@@ -0,0 +1,150 @@
+package serfer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func tagged(name string, tags map[string]string) serf.Member {
+	return serf.Member{Name: name, Tags: tags}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	server := tagged("a", map[string]string{"role": "server", "dc": "east", "version": "1.2.0", "leader": ""})
+	client := tagged("b", map[string]string{"role": "client", "dc": "west", "version": "0.9.1"})
+	bare := tagged("c", nil)
+
+	for selector, expected := range map[string][]bool{
+		"":                           {true, true, true},
+		"role=server":                {true, false, false},
+		"role == server":             {true, false, false},
+		"role!=server":               {false, true, true},
+		"role=server,dc=east":        {true, false, false},
+		"dc in (east, north)":        {true, false, false},
+		"dc notin (east)":            {false, true, true},
+		"leader":                     {true, false, false},
+		"!leader":                    {false, true, true},
+		`version=~^1\.`:              {true, false, false},
+		`version!~^1\.`:              {false, true, true},
+		"role in (server,client),!x": {true, true, false},
+		`version=~^[01]\.\d{1,3},dc`: {true, true, false},
+		`version=~^(0|1)\.[0-9.,]+$`: {true, true, false},
+	} {
+		sel, err := ParseSelector(selector)
+		if !assert.Nil(t, err, selector) {
+			continue
+		}
+		for i, m := range []serf.Member{server, client, bare} {
+			assert.Equal(t, expected[i], sel.Matches(m), "%s on %s", selector, m.Name)
+		}
+	}
+}
+
+func TestSelector_Invalid(t *testing.T) {
+	for _, selector := range []string{
+		"=server", "role=~(", "a b", "role~server", ",", "!",
+		"dc in ()", "dc in (east,)", "dc notin ( )",
+		"name=a},role=server", "name=a),role=server", "name=a],role=server",
+		`version=~^1\.\d{1,3`, "dc in (east",
+	} {
+		_, err := ParseSelector(selector)
+		assert.NotNil(t, err, selector)
+	}
+	assert.Panics(t, func() {
+		MustParseSelector("=")
+	})
+	assert.Equal(t, "role=server", MustParseSelector(" role=server ").String())
+}
+
+func TestSelector_Escaped(t *testing.T) {
+	comma := tagged("a", map[string]string{"role": "a,b", "name": "x}"})
+	plain := tagged("b", map[string]string{"role": "a", "name": "x"})
+
+	for selector, expected := range map[string][]bool{
+		`role=a\,b`:          {true, false},
+		`role in (a\,b, c)`:  {true, false},
+		`role in (a, c)`:     {false, true},
+		`name=x\},role=a\,b`: {true, false},
+		`role=~^a\,b$`:       {true, false},
+	} {
+		sel, err := ParseSelector(selector)
+		if !assert.Nil(t, err, selector) {
+			continue
+		}
+		for i, m := range []serf.Member{comma, plain} {
+			assert.Equal(t, expected[i], sel.Matches(m), "%s on %s", selector, m.Name)
+		}
+	}
+}
+
+func TestMemberFilter(t *testing.T) {
+	handler := &recordingHandler{}
+	var joined []string
+	filter := MemberFilter{
+		Selector: MustParseSelector("role=server"),
+		Handler:  joinNames{&joined},
+	}
+
+	e := serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{
+		tagged("a", map[string]string{"role": "server"}),
+		tagged("b", map[string]string{"role": "client"}),
+		tagged("c", map[string]string{"role": "server"}),
+	}}
+	filter.HandleMemberJoin(e)
+	filter.HandleMemberJoin(serf.MemberEvent{Type: serf.EventMemberJoin, Members: e.Members[1:2]})
+	assert.Equal(t, []string{"a,c"}, joined, "the handler is not called when no member matches")
+
+	// Events the wrapped handler does not handle are ignored
+	filter.Handler = handler
+	filter.HandleMemberLeave(e)
+	assert.Len(t, handler.recorded(), 0)
+}
+
+func TestRegistry_RegisterSelector(t *testing.T) {
+	rec := &flakyReconciler{}
+	r := NewRegistry(SerfEventHandler{
+		IsLeader:        func() bool { return true },
+		ReconcileOnJoin: true,
+		Logger:          &log.NullLogger{},
+	}, FanOutSequential)
+
+	var joined []string
+	_, err := r.RegisterSelector(KindMemberJoin, "dc=east", joinNames{&joined})
+	assert.Nil(t, err)
+	_, err = r.RegisterSelector(KindReconcile, "role=server", rec)
+	assert.Nil(t, err)
+
+	_, err = r.RegisterSelector(KindUserEvent, "dc=east", &MockEventHandler{})
+	assert.NotNil(t, err)
+	_, err = r.RegisterSelector(KindMemberJoin, "dc=", &MockEventHandler{})
+	assert.Nil(t, err, "empty values are valid")
+	_, err = r.RegisterSelector(KindMemberJoin, "dc in (", &MockEventHandler{})
+	assert.NotNil(t, err)
+	_, err = r.RegisterSelector(KindMemberJoin, "dc=east", &deadLetters{})
+	assert.NotNil(t, err)
+
+	r.HandleEvent(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{
+		tagged("a", map[string]string{"role": "server", "dc": "east"}),
+		tagged("b", map[string]string{"role": "client", "dc": "east"}),
+		tagged("c", map[string]string{"role": "server", "dc": "west"}),
+	}})
+	assert.Equal(t, []string{"a,b"}, joined)
+	assert.Equal(t, 2, rec.calls)
+}
+
+// joinNames records the names of the joined members of each event.
+type joinNames struct {
+	joined *[]string
+}
+
+func (j joinNames) HandleMemberJoin(e serf.MemberEvent) {
+	var names []string
+	for _, m := range e.Members {
+		names = append(names, m.Name)
+	}
+	*j.joined = append(*j.joined, strings.Join(names, ","))
+}
@@ -1,51 +1,783 @@
 package serfer
 
 import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
 	tomb "gopkg.in/tomb.v2"
 )
 
+// workerBufferSize is the number of events each worker can have pending
+// before the dispatcher blocks on it.
+const workerBufferSize = 16
+
+var (
+	// ErrSourceClosed is returned when the Serfer terminates because all of its
+	// event channels were closed.
+	ErrSourceClosed = errors.New("serfer: event channel closed")
+
+	// ErrStarted is returned when a source is attached after the Serfer started.
+	ErrStarted = errors.New("serfer: already started")
+
+	// ErrDuplicateSource is returned when a source name is attached twice.
+	ErrDuplicateSource = errors.New("serfer: duplicate source")
+)
+
+// DefaultSource is the name of the source created from the channel passed to NewSerfer.
+const DefaultSource = "default"
+
 // Serfer processes Serf.Events and is meant to be ran in a goroutine.
 type Serfer interface {
 
 	// Start starts the serfer goroutine.
 	Start()
 
-	// Stop stops all event processing and blocks until finished.
+	// Run processes events until the context is done or the event channel is
+	// closed. The context is passed to handlers implementing ContextEventHandler
+	// and is cancelled when event processing stops.
+	Run(context.Context) error
+
+	// Stop stops all event processing and blocks until finished. Events which
+	// have not been handled yet are discarded.
 	Stop() error
+
+	// StopWithTimeout stops reading new events and processes the events already
+	// buffered, including those left in the event channels, until the timeout
+	// expires. It returns the number of events which were abandoned when the
+	// timeout expired. An event split between several workers counts once.
+	StopWithTimeout(time.Duration) (int, error)
+
+	// Wait blocks until the Serfer terminates and returns the reason. If every
+	// event channel is closed, the buffered events are processed and Wait
+	// returns ErrSourceClosed.
+	Wait() error
+
+	// AddSource attaches another named event channel, such as a WAN pool. Events
+	// from it are dispatched to the given handler, or to the Serfer's handler if
+	// it is nil. The source name is available to handlers through SourceFromContext.
+	// Sources must be attached before the Serfer is started.
+	AddSource(name string, c <-chan serf.Event, handler EventHandler) error
+
+	// Pause stops dispatching events to handlers. Events keep being read and are
+	// buffered, up to Config.PauseQueueSize, applying the overflow policy when the
+	// buffer is full. Events which already reached a worker are held there, and
+	// an event already being handled is not interrupted.
+	Pause()
+
+	// Resume dispatches the events buffered while paused, in order, and continues
+	// normal processing.
+	Resume()
+
+	// Stats returns dispatcher statistics in the same form as serf.Serf.Stats:
+	// the number of pending events, the events received per type, the calls per
+	// SerfEventHandler handler kind, the handler errors and panics, the worker
+	// restarts, the time of the last event and percentiles of recent handler
+	// latencies.
+	Stats() map[string]string
 }
 
 // NewSerfer returns a new Serfer implementation that uses the given channel and event handlers.
-func NewSerfer(c chan serf.Event, handler EventHandler) Serfer {
-	var t tomb.Tomb
-	return &serfer{handler, c, t}
+// The channel is attached as DefaultSource. If it is nil, sources must be attached with AddSource.
+//
+// Events are processed by a pool of workers. Events about the same member are always
+// handled by the same worker, so they are delivered in the order they were received.
+// A workers value less than 1 uses a single worker.
+func NewSerfer(c chan serf.Event, handler EventHandler, workers int) Serfer {
+	conf := DefaultConfig()
+	conf.Workers = workers
+	return NewSerferConfig(c, handler, conf)
+}
+
+// NewSerferConfig returns a new Serfer implementation that uses the given channel,
+// event handlers and configuration. Events read from the channel are buffered in a
+// bounded queue which applies the configured OverflowPolicy when full.
+func NewSerferConfig(c chan serf.Event, handler EventHandler, conf *Config) Serfer {
+	// Apply the defaults to a copy so the caller's Config is left untouched
+	copied := *conf
+	conf = &copied
+
+	workers := conf.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if conf.Logger == nil {
+		conf.Logger = log.New("serfer")
+	}
+	if conf.PauseQueueSize < conf.QueueSize {
+		conf.PauseQueueSize = conf.QueueSize
+	}
+
+	s := &serfer{
+		conf:    *conf,
+		handler: handler,
+		queue:   newQueue(conf.QueueSize, conf.OverflowPolicy, conf.SheddableTypes, conf.OverflowHandler),
+		workers: make([]chan envelope, workers),
+		closing: make(chan struct{}),
+		resumed: make(chan struct{}),
+		stats:   newStats(),
+	}
+	close(s.resumed)
+	s.queue.dropped = s.drop
+	for i := range s.workers {
+		s.workers[i] = make(chan envelope, workerBufferSize)
+	}
+	if c != nil {
+		s.AddSource(DefaultSource, c, nil)
+	}
+	return s
 }
 
 type serfer struct {
+	conf    Config
 	handler EventHandler
-	channel chan serf.Event
+	queue   *queue
+	workers []chan envelope
 	t       tomb.Tomb
+
+	// ctx is the parent of every handler context. It is cancelled when the
+	// Serfer starts dying.
+	ctx context.Context
+
+	// sources are the event channels being read.
+	sources []*source
+	started bool
+	l       sync.Mutex
+
+	// closing is closed to stop reading from the event channels.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// reading tracks the sources which are still being read and closed
+	// counts the ones whose channel was closed.
+	reading sync.WaitGroup
+	closed  int32
+
+	// sourceErr is set if every event channel was closed.
+	sourceErr error
+
+	// abandoned counts the events which were read but will not be handled.
+	abandoned int32
+
+	// inflight counts the events routed to the workers which have parts
+	// left to handle.
+	inflight int32
+
+	// running tracks the workers which have not exited yet.
+	running sync.WaitGroup
+
+	// resumed is closed while the Serfer is not paused.
+	resumed chan struct{}
+	pauseMu sync.Mutex
+
+	stats *stats
 }
 
 func (s *serfer) Start() {
+	s.start(context.Background())
+}
+
+func (s *serfer) Run(ctx context.Context) error {
+	s.start(ctx)
+
+	select {
+	case <-ctx.Done():
+		return s.Stop()
+	case <-s.t.Dead():
+		return s.t.Err()
+	}
+}
+
+func (s *serfer) AddSource(name string, c <-chan serf.Event, handler EventHandler) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.started {
+		return ErrStarted
+	}
+	for _, src := range s.sources {
+		if src.name == name {
+			return ErrDuplicateSource
+		}
+	}
+
+	if handler == nil {
+		handler = s.handler
+	}
+	s.sources = append(s.sources, &source{name: name, channel: c, handler: handler})
+	return nil
+}
+
+// start launches the Serfer goroutines with handler contexts derived from ctx.
+func (s *serfer) start(ctx context.Context) {
+	s.l.Lock()
+	s.started = true
+	s.l.Unlock()
+
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithCancel(withStats(ctx, s.stats))
+
+	// Cancel handler contexts as soon as the Serfer starts dying
 	s.t.Go(func() error {
-		// Start event processing
-		for {
-			select {
+		<-s.t.Dying()
+		cancel()
+		return nil
+	})
+
+	// Start the workers
+	for _, w := range s.workers {
+		s.spawn(w)
+	}
 
-			// Handle context close
-			case <-s.t.Dying():
+	// Start routing queued events to the workers
+	s.t.Go(s.distribute)
+
+	// Replay the journal, then start reading the sources
+	s.t.Go(s.feed)
+}
+
+// feed replays the events left in the journal and reads the sources. Once
+// every source stops, it closes the queue so that it drains.
+func (s *serfer) feed() error {
+	if err := s.replay(); err != nil {
+		return err
+	}
+
+	for _, src := range s.sources {
+		src := src
+		s.reading.Add(1)
+		s.t.Go(func() error {
+			defer s.reading.Done()
+			return s.read(src)
+		})
+	}
+
+	s.reading.Wait()
+	if int(atomic.LoadInt32(&s.closed)) == len(s.sources) {
+		s.sourceErr = ErrSourceClosed
+	}
+	s.queue.close()
+	return nil
+}
+
+// replay queues the events which were journaled but not handled before the
+// Serfer last stopped. Events from a source which is no longer attached are
+// dispatched to the Serfer's handler.
+func (s *serfer) replay() error {
+	if s.conf.Journal == nil {
+		return nil
+	}
+
+	entries, err := s.conf.Journal.Pending()
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		s.conf.Logger.Info("serfer: replaying journal", "events", len(entries))
+	}
+
+	for _, e := range entries {
+		src := s.source(e.Source)
+		if src == nil {
+			src = &source{name: e.Source, handler: s.handler}
+		}
+		env := envelope{
+			event:    e.Event,
+			received: e.Received,
+			source:   src,
+			ticket:   &ticket{seq: e.Seq, parts: 1},
+			replayed: true,
+		}
+		if !s.queue.push(env, s.t.Dying()) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// source returns the attached source with the given name.
+func (s *serfer) source(name string) *source {
+	for _, src := range s.sources {
+		if src.name == name {
+			return src
+		}
+	}
+	return nil
+}
+
+// journal records an event in the journal before it is queued. Events which
+// cannot be journaled are still dispatched.
+func (s *serfer) journal(env *envelope) {
+	if s.conf.Journal == nil {
+		return
+	}
+
+	seq, err := s.conf.Journal.Append(JournalEntry{Source: env.source.name, Received: env.received, Event: env.event})
+	if err != nil {
+		s.conf.Logger.Warn("serfer: failed to journal event", "event", env.event, "err", err)
+		return
+	}
+	env.ticket = &ticket{seq: seq, parts: 1}
+}
+
+// drop releases an event dropped by the overflow policy.
+func (s *serfer) drop(env envelope) {
+	metrics.IncrCounter(metricsKey(s.conf.MetricsPrefix, "dropped", eventTypeName(env.event)), 1)
+	s.release(env)
+}
+
+// measure emits the metrics of a handled event.
+func (s *serfer) measure(env envelope, start time.Time, err error, perr *PanicError) {
+	name := eventTypeName(env.event)
+	result := outcome(err)
+	if perr != nil {
+		result = outcomePanic
+	}
+	metrics.IncrCounter(metricsKey(s.conf.MetricsPrefix, "dispatch", name, result), 1)
+	metrics.MeasureSince(metricsKey(s.conf.MetricsPrefix, "dispatch", name), start)
+	metrics.MeasureSince(metricsKey(s.conf.MetricsPrefix, "latency", name), env.received)
+}
+
+// release marks a part of an event as done and acknowledges its journal entry
+// once every part is done.
+func (s *serfer) release(env envelope) {
+	if env.ticket == nil || atomic.AddInt32(&env.ticket.parts, -1) != 0 {
+		return
+	}
+	if err := s.conf.Journal.Ack(env.ticket.seq); err != nil {
+		s.conf.Logger.Warn("serfer: failed to acknowledge event", "event", env.event, "err", err)
+	}
+}
+
+// read pushes the events of a source onto the queue until the source is
+// closed or the Serfer stops reading.
+func (s *serfer) read(src *source) error {
+	// Start event processing
+	for {
+		select {
+
+		// Handle context close
+		case <-s.t.Dying():
+			if s.isClosing() {
+				s.drain(src)
+			}
+			return nil
+
+		// Handle graceful shutdown
+		case <-s.closing:
+			s.drain(src)
+			return nil
+
+		// Handle serf events
+		case evt, ok := <-src.channel:
+			if !ok {
+				s.conf.Logger.Warn("serfer: event channel closed", "source", src.name)
+				atomic.AddInt32(&s.closed, 1)
 				return nil
+			}
+			s.enqueue(src, evt)
+		}
+	}
+}
 
-			// Handle serf events
-			case evt := <-s.channel:
-				s.handler.HandleEvent(evt)
+// drain queues the events already buffered in a source channel once the
+// Serfer stops reading, without waiting for more. Events which cannot be
+// queued because the Serfer is dying are abandoned.
+func (s *serfer) drain(src *source) {
+	for {
+		select {
+		case evt, ok := <-src.channel:
+			if !ok {
+				return
 			}
+			s.enqueue(src, evt)
+		default:
+			return
 		}
-	})
+	}
+}
+
+// enqueue journals an event read from a source and pushes it onto the queue.
+// The event is abandoned if the Serfer dies before there is room for it.
+func (s *serfer) enqueue(src *source, evt serf.Event) {
+	env := envelope{event: evt, received: time.Now(), source: src}
+	s.stats.received(evt, env.received)
+	metrics.IncrCounter(metricsKey(s.conf.MetricsPrefix, "received", eventTypeName(evt)), 1)
+	s.journal(&env)
+	if !s.queue.push(env, s.t.Dying()) {
+		atomic.AddInt32(&s.abandoned, 1)
+	}
+}
+
+// isClosing returns true once StopWithTimeout has been called.
+func (s *serfer) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *serfer) Stop() error {
 	s.t.Kill(nil)
 	return s.t.Wait()
 }
+
+func (s *serfer) StopWithTimeout(timeout time.Duration) (int, error) {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+
+	// Buffered events cannot drain while paused
+	s.Resume()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.t.Dead():
+	case <-timer.C:
+		s.t.Kill(nil)
+	}
+
+	err := s.t.Wait()
+
+	// Abandon the events left with the workers
+	for _, w := range s.workers {
+		s.abandonWorker(w)
+	}
+	return s.pending(), err
+}
+
+// abandonWorker abandons the events left in the channel of a stopped worker.
+func (s *serfer) abandonWorker(c chan envelope) {
+	for {
+		select {
+		case env, ok := <-c:
+			if !ok {
+				return
+			}
+			s.abandon(env.origin, 1)
+		default:
+			return
+		}
+	}
+}
+
+func (s *serfer) Wait() error {
+	return s.t.Wait()
+}
+
+func (s *serfer) Pause() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	select {
+	case <-s.resumed:
+		s.resumed = make(chan struct{})
+		s.queue.resize(s.conf.PauseQueueSize)
+	default:
+	}
+}
+
+func (s *serfer) Resume() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	select {
+	case <-s.resumed:
+	default:
+		s.queue.resize(s.conf.QueueSize)
+		close(s.resumed)
+	}
+}
+
+func (s *serfer) Stats() map[string]string {
+	stats := s.stats.snapshot()
+	stats["queue_depth"] = strconv.Itoa(s.pending())
+	stats["workers"] = strconv.Itoa(len(s.workers))
+
+	s.pauseMu.Lock()
+	select {
+	case <-s.resumed:
+		stats["paused"] = "false"
+	default:
+		stats["paused"] = "true"
+	}
+	s.pauseMu.Unlock()
+	return stats
+}
+
+// waitResumed blocks while the Serfer is paused. It returns false if the
+// Serfer started dying.
+func (s *serfer) waitResumed() bool {
+	s.pauseMu.Lock()
+	resumed := s.resumed
+	s.pauseMu.Unlock()
+
+	select {
+	case <-resumed:
+		return true
+	case <-s.t.Dying():
+		return false
+	}
+}
+
+// pending returns the number of events read from the sources which were
+// not handled yet. An event split between several workers counts once.
+func (s *serfer) pending() int {
+	return s.queue.len() + int(atomic.LoadInt32(&s.inflight)) + int(atomic.LoadInt32(&s.abandoned))
+}
+
+// distribute hands queued events to the workers until the queue is closed
+// and empty, then waits for the workers to finish.
+func (s *serfer) distribute() error {
+	for {
+		// Keep events in the queue while paused so that PauseQueueSize caps
+		// what is buffered, rather than filling the worker channels.
+		if !s.waitResumed() {
+			break
+		}
+		env, ok := s.queue.pop(s.t.Dying())
+		if !ok {
+			break
+		}
+		metrics.SetGauge(metricsKey(s.conf.MetricsPrefix, "queue_depth"), float32(s.queue.len()))
+		s.dispatch(env)
+	}
+
+	select {
+	case <-s.t.Dying():
+		return nil
+	default:
+	}
+
+	// The queue has been drained, so stop the workers once they are done.
+	for _, w := range s.workers {
+		close(w)
+	}
+	s.running.Wait()
+	s.t.Kill(s.sourceErr)
+	return nil
+}
+
+// spawn starts a worker goroutine reading from c.
+func (s *serfer) spawn(c chan envelope) {
+	s.running.Add(1)
+	s.t.Go(func() error {
+		defer s.running.Done()
+		return s.work(c)
+	})
+}
+
+// work handles the events routed to a single worker.
+func (s *serfer) work(c chan envelope) error {
+	for {
+		// Stop before taking another event if the Serfer is dying
+		select {
+		case <-s.t.Dying():
+			return nil
+		default:
+		}
+
+		select {
+		case <-s.t.Dying():
+			return nil
+		case env, ok := <-c:
+			if !ok {
+				return nil
+			}
+
+			// Hold the event while paused
+			if !s.waitResumed() {
+				s.abandon(env.origin, 1)
+				return nil
+			}
+
+			start := time.Now()
+			ctx := withScheduler(env.context(s.ctx), sourceScheduler{s, env.source})
+			var err error
+			perr := recoverEvent(env.event, func() {
+				if env.task != nil {
+					err = env.task(ctx)
+					return
+				}
+				err = handleEvent(ctx, env.source.handler, env.event)
+			})
+			s.stats.handled(time.Since(start), err, perr)
+			if env.task == nil {
+				s.measure(env, start, err, perr)
+			}
+			if err != nil {
+				s.conf.Logger.Warn("serfer: event handler failed", "event", env.event, "err", err)
+			}
+			s.release(env)
+			s.done(env.origin)
+			if perr == nil {
+				continue
+			}
+
+			s.conf.Logger.Error("serfer: handler panicked", "event", env.event, "panic", perr.Value, "policy", s.conf.PanicPolicy)
+			if s.conf.DeadLetterHandler != nil {
+				s.conf.DeadLetterHandler.HandleDeadLetter(DeadLetter{
+					Source: env.source.name,
+					Event:  env.event,
+					Value:  perr.Value,
+					Stack:  perr.Stack,
+					Time:   time.Now(),
+				})
+			}
+
+			switch s.conf.PanicPolicy {
+			case PanicRestart:
+				s.stats.restarted()
+				s.spawn(c)
+				return nil
+			case PanicStop:
+				return perr
+			}
+		}
+	}
+}
+
+// sourceScheduler schedules tasks on the workers of a Serfer on behalf of the
+// handler of a source.
+type sourceScheduler struct {
+	s   *serfer
+	src *source
+}
+
+func (sc sourceScheduler) schedule(e serf.MemberEvent, task func(context.Context) error) bool {
+	if sc.s.isClosing() {
+		return false
+	}
+	select {
+	case <-sc.s.t.Dying():
+		return false
+	default:
+	}
+	return sc.s.queue.insert(envelope{event: e, received: time.Now(), source: sc.src, task: task})
+}
+
+func (sc sourceScheduler) stopped() <-chan struct{} {
+	return sc.s.t.Dying()
+}
+
+// origin is an event routed to the workers, possibly split in several parts.
+type origin struct {
+	event     serf.Event
+	parts     int32
+	abandoned int32
+}
+
+// dispatch routes an event to the workers responsible for it.
+func (s *serfer) dispatch(env envelope) {
+	routes := s.routes(env.event)
+	if env.ticket != nil && len(routes) > 1 {
+		atomic.AddInt32(&env.ticket.parts, int32(len(routes)-1))
+	}
+
+	env.origin = &origin{event: env.event, parts: int32(len(routes))}
+	atomic.AddInt32(&s.inflight, 1)
+	for i, r := range routes {
+		env.event = r.event
+		select {
+		case <-s.t.Dying():
+			s.abandon(env.origin, len(routes)-i)
+			return
+		case s.workers[r.worker] <- env:
+		}
+	}
+}
+
+// done marks a part of a routed event as handled.
+func (s *serfer) done(o *origin) {
+	if atomic.AddInt32(&o.parts, -1) == 0 {
+		atomic.AddInt32(&s.inflight, -1)
+	}
+}
+
+// abandon marks parts of a routed event as abandoned. The event is counted
+// once however many of its parts are abandoned.
+func (s *serfer) abandon(o *origin, parts int) {
+	if atomic.CompareAndSwapInt32(&o.abandoned, 0, 1) {
+		atomic.AddInt32(&s.abandoned, 1)
+	}
+	if atomic.AddInt32(&o.parts, -int32(parts)) == 0 {
+		atomic.AddInt32(&s.inflight, -1)
+	}
+}
+
+// routedEvent is an event assigned to a worker.
+type routedEvent struct {
+	worker int
+	event  serf.Event
+}
+
+// routes determines which workers should handle an event. Member events are
+// split so that each member is handled by the worker that owns its name.
+// User events are keyed by name and queries by their Lamport time, which is
+// the only public identifier serf exposes for a query.
+func (s *serfer) routes(evt serf.Event) []routedEvent {
+	switch e := evt.(type) {
+	case serf.MemberEvent:
+		return s.routeMembers(e)
+	case serf.UserEvent:
+		return []routedEvent{{s.worker(e.Name), e}}
+	case *serf.Query:
+		return []routedEvent{{s.worker(e.Name + ":" + strconv.FormatUint(uint64(e.LTime), 10)), e}}
+	default:
+		return []routedEvent{{0, evt}}
+	}
+}
+
+// routeMembers splits a member event into one event per worker, keeping
+// the original member order within each worker.
+func (s *serfer) routeMembers(e serf.MemberEvent) []routedEvent {
+	if len(s.workers) == 1 || len(e.Members) < 2 {
+		var key string
+		if len(e.Members) > 0 {
+			key = e.Members[0].Name
+		}
+		return []routedEvent{{s.worker(key), e}}
+	}
+
+	var routes []routedEvent
+	index := make(map[int]int)
+	for _, m := range e.Members {
+		w := s.worker(m.Name)
+		i, ok := index[w]
+		if !ok {
+			i = len(routes)
+			index[w] = i
+			routes = append(routes, routedEvent{w, serf.MemberEvent{Type: e.Type}})
+		}
+		me := routes[i].event.(serf.MemberEvent)
+		me.Members = append(me.Members, m)
+		routes[i].event = me
+	}
+
+	// Deliver the original event if every member belongs to the same worker
+	if len(routes) == 1 {
+		routes[0].event = e
+	}
+	return routes
+}
+
+// worker returns the index of the worker that owns the given key.
+func (s *serfer) worker(key string) int {
+	if len(s.workers) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.workers)))
+}
@@ -1,17 +1,24 @@
 package serfer
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	tomb "gopkg.in/tomb.v2"
 )
 
 func TestRunSerfer(t *testing.T) {
 
 	// Create event
 	evt := &MockEvent{}
+	evt.On("EventType").Return()
 
 	// Create handler
 	handler := &MockEventHandler{}
@@ -19,13 +26,11 @@ func TestRunSerfer(t *testing.T) {
 
 	// Create channel and serfer
 	ch := make(chan serf.Event, 1)
-	serfer := NewSerfer(ch, handler)
+	processed := make(chan struct{}, 2)
+	serfer := NewSerfer(ch, &notifyingHandler{handler, processed}, 1)
 
 	// Start serfer
 	serfer.Start()
-	// death.Go(func() error {
-	// 	return serfer.Run(ctx)
-	// })
 
 	// Send events
 	select {
@@ -35,6 +40,15 @@ func TestRunSerfer(t *testing.T) {
 	}
 	ch <- evt
 
+	// Wait for both events to be handled
+	for i := 0; i < 2; i++ {
+		select {
+		case <-processed:
+		case <-time.After(time.Second):
+			t.Fatal("Event was not processed")
+		}
+	}
+
 	// Verify stopped without error
 	assert.Nil(t, serfer.Stop(), "Error should be nil")
 
@@ -42,3 +56,356 @@ func TestRunSerfer(t *testing.T) {
 	handler.AssertCalled(t, "HandleEvent", evt)
 
 }
+
+// notifyingHandler signals a channel after each event is handled.
+type notifyingHandler struct {
+	handler EventHandler
+	done    chan struct{}
+}
+
+func (n *notifyingHandler) HandleEvent(e serf.Event) {
+	n.handler.HandleEvent(e)
+	n.done <- struct{}{}
+}
+
+// recordingHandler records the member names of processed events in order.
+type recordingHandler struct {
+	sync.Mutex
+	names []string
+	block map[string]chan struct{}
+}
+
+func (r *recordingHandler) HandleEvent(e serf.Event) {
+	me, ok := e.(serf.MemberEvent)
+	if !ok {
+		return
+	}
+	for _, m := range me.Members {
+		r.Lock()
+		c := r.block[m.Name]
+		r.Unlock()
+		if c != nil {
+			<-c
+		}
+		r.Lock()
+		r.names = append(r.names, fmt.Sprintf("%s:%s", m.Name, me.Type))
+		r.Unlock()
+	}
+}
+
+func (r *recordingHandler) recorded() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+// waitFor fails the test if cond does not become true within a second.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func memberEvent(t serf.EventType, names ...string) serf.MemberEvent {
+	e := serf.MemberEvent{Type: t}
+	for _, n := range names {
+		e.Members = append(e.Members, serf.Member{Name: n})
+	}
+	return e
+}
+
+func TestSerfer_PerMemberOrdering(t *testing.T) {
+	handler := &recordingHandler{}
+	ch := make(chan serf.Event)
+	s := NewSerfer(ch, handler, 4)
+	s.Start()
+
+	for i := 0; i < 20; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a", "b", "c")
+		ch <- memberEvent(serf.EventMemberFailed, "a", "b", "c")
+	}
+
+	waitFor(t, func() bool {
+		return len(handler.recorded()) == 120
+	})
+	assert.Nil(t, s.Stop())
+
+	// Events for each member should alternate between join and failed
+	last := make(map[string]string)
+	for _, r := range handler.recorded() {
+		var name, typ string
+		fmt.Sscanf(r, "%1s:%s", &name, &typ)
+		assert.NotEqual(t, last[name], typ, "events for %s out of order", name)
+		last[name] = typ
+	}
+}
+
+func TestSerfer_SlowMemberDoesNotBlockOthers(t *testing.T) {
+	s := NewSerfer(nil, nil, 8).(*serfer)
+
+	// Find two members owned by different workers
+	slow, fast := "slow", ""
+	for i := 0; fast == ""; i++ {
+		n := fmt.Sprintf("node-%d", i)
+		if s.worker(n) != s.worker(slow) {
+			fast = n
+		}
+	}
+
+	release := make(chan struct{})
+	handler := &recordingHandler{block: map[string]chan struct{}{slow: release}}
+	ch := make(chan serf.Event)
+	s = NewSerfer(ch, handler, 8).(*serfer)
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, slow)
+	ch <- memberEvent(serf.EventMemberJoin, fast)
+	waitFor(t, func() bool {
+		r := handler.recorded()
+		return len(r) == 1 && r[0] == fast+":member-join"
+	})
+
+	close(release)
+	waitFor(t, func() bool {
+		return len(handler.recorded()) == 2
+	})
+	assert.Nil(t, s.Stop())
+}
+
+func TestSerfer_RouteSplitsMemberEvents(t *testing.T) {
+	s := NewSerfer(nil, nil, 4).(*serfer)
+
+	evt := memberEvent(serf.EventMemberJoin, "a", "b", "c", "d", "e", "f")
+	var total int
+	for _, r := range s.routes(evt) {
+		me := r.event.(serf.MemberEvent)
+		assert.Equal(t, serf.EventMemberJoin, me.Type)
+		for _, m := range me.Members {
+			assert.Equal(t, r.worker, s.worker(m.Name))
+		}
+		total += len(me.Members)
+	}
+	assert.Equal(t, 6, total)
+
+	// A single worker receives the original event
+	s = NewSerfer(nil, nil, 1).(*serfer)
+	assert.Equal(t, []routedEvent{{0, evt}}, s.routes(evt))
+}
+
+func TestSerfer_StopWithTimeoutDrains(t *testing.T) {
+	handler := &recordingHandler{}
+	ch := make(chan serf.Event, 10)
+	s := NewSerfer(ch, handler, 2)
+	for i := 0; i < 10; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, fmt.Sprintf("node-%d", i))
+	}
+	s.Start()
+
+	// Wait for the channel to be read before stopping
+	waitFor(t, func() bool {
+		return len(ch) == 0
+	})
+
+	n, err := s.StopWithTimeout(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Len(t, handler.recorded(), 10)
+}
+
+func TestSerfer_StopWithTimeoutAbandons(t *testing.T) {
+	release := make(chan struct{})
+	handler := &recordingHandler{block: map[string]chan struct{}{"a": release}}
+	ch := make(chan serf.Event, 5)
+	s := NewSerfer(ch, handler, 1)
+	for i := 0; i < 5; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a")
+	}
+	s.Start()
+	waitFor(t, func() bool {
+		return len(ch) == 0
+	})
+
+	// Unblock the handler after the deadline has passed
+	time.AfterFunc(50*time.Millisecond, func() {
+		close(release)
+	})
+
+	n, err := s.StopWithTimeout(10 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, n > 0, "events should have been abandoned")
+	assert.Equal(t, 5, n+len(handler.recorded()))
+}
+
+func TestSerfer_StopWithTimeoutAbandonsChannel(t *testing.T) {
+	release := make(chan struct{})
+	handler := &recordingHandler{block: map[string]chan struct{}{"a": release}}
+	ch := make(chan serf.Event, 10)
+	conf := DefaultConfig()
+	conf.Workers = 4
+	conf.QueueSize = 1
+	conf.Logger = &log.NullLogger{}
+	s := NewSerferConfig(ch, handler, conf)
+
+	// Split every event between two workers
+	other := "b"
+	for i := 0; s.(*serfer).worker(other) == s.(*serfer).worker("a"); i++ {
+		other = fmt.Sprintf("b%d", i)
+	}
+	for i := 0; i < 10; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a", other)
+	}
+	s.Start()
+
+	// The events left in the channel are read and counted once stopping
+	time.AfterFunc(50*time.Millisecond, func() {
+		close(release)
+	})
+	n, err := s.StopWithTimeout(10 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, ch, 0, "the channel should have been drained")
+	assert.True(t, n > 0, "events should have been abandoned")
+
+	var handled int
+	for _, name := range handler.recorded() {
+		if strings.HasPrefix(name, "a:") {
+			handled++
+		}
+	}
+	assert.Equal(t, 10, n+handled, "split events are counted once")
+}
+
+func TestNewSerferConfig_CopiesConfig(t *testing.T) {
+	conf := &Config{QueueSize: 8}
+	NewSerferConfig(nil, &recordingHandler{}, conf)
+	assert.Equal(t, &Config{QueueSize: 8}, conf)
+}
+
+func TestSerfer_SourceClosed(t *testing.T) {
+	handler := &MockEventHandler{}
+	evt := memberEvent(serf.EventMemberJoin, "a")
+	handler.On("HandleEvent", evt).Return()
+
+	ch := make(chan serf.Event, 3)
+	ch <- evt
+	ch <- evt
+	close(ch)
+
+	s := NewSerfer(ch, handler, 1)
+	s.Start()
+
+	assert.Equal(t, ErrSourceClosed, s.Wait())
+	handler.AssertNumberOfCalls(t, "HandleEvent", 2)
+	handler.AssertNotCalled(t, "HandleEvent", nil)
+	assert.Equal(t, ErrSourceClosed, s.Stop())
+}
+
+// contextHandler records the contexts events are handled with.
+type contextHandler struct {
+	contexts chan context.Context
+}
+
+func (c *contextHandler) HandleEvent(e serf.Event) {
+	panic("HandleEventContext should be preferred")
+}
+
+func (c *contextHandler) HandleEventContext(ctx context.Context, e serf.Event) {
+	c.contexts <- ctx
+}
+
+func TestSerfer_Run(t *testing.T) {
+	handler := &contextHandler{make(chan context.Context, 1)}
+	ch := make(chan serf.Event, 1)
+	s := NewSerfer(ch, handler, 1)
+
+	var death tomb.Tomb
+	ctx, cancel := context.WithCancel(context.Background())
+	death.Go(func() error {
+		return s.Run(ctx)
+	})
+
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	var hctx context.Context
+	select {
+	case hctx = <-handler.contexts:
+	case <-time.After(time.Second):
+		t.Fatal("Event was not processed")
+	}
+
+	_, ok := ReceivedAt(hctx)
+	assert.True(t, ok, "handler context should carry the receive time")
+	assert.Nil(t, hctx.Err())
+
+	// Cancelling the parent context stops the Serfer and its handler contexts
+	cancel()
+	assert.Nil(t, death.Wait())
+	assert.Equal(t, context.Canceled, hctx.Err())
+}
+
+func TestSerfer_RunSourceClosed(t *testing.T) {
+	ch := make(chan serf.Event)
+	close(ch)
+
+	s := NewSerfer(ch, &MockEventHandler{}, 1)
+	assert.Equal(t, ErrSourceClosed, s.Run(context.Background()))
+}
+
+func TestSerfer_PauseResume(t *testing.T) {
+	handler := &recordingHandler{}
+	ch := make(chan serf.Event)
+	s := NewSerfer(ch, handler, 1)
+	s.Start()
+
+	s.Pause()
+	for i := 0; i < 5; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, fmt.Sprintf("%d", i))
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, handler.recorded())
+
+	s.Resume()
+	waitFor(t, func() bool {
+		return len(handler.recorded()) == 5
+	})
+	assert.Equal(t, []string{
+		"0:member-join", "1:member-join", "2:member-join", "3:member-join", "4:member-join",
+	}, handler.recorded())
+	assert.Nil(t, s.Stop())
+}
+
+func TestSerfer_PauseOverflow(t *testing.T) {
+	rec := &overflowRecorder{}
+	handler := &recordingHandler{}
+	conf := DefaultConfig()
+	conf.QueueSize = 1
+	conf.PauseQueueSize = 2
+	conf.OverflowPolicy = OverflowDropNewest
+	conf.OverflowHandler = rec
+
+	ch := make(chan serf.Event)
+	s := NewSerferConfig(ch, handler, conf)
+	s.Start()
+	s.Pause()
+
+	// Only the pause buffer, and an event the dispatcher may have taken
+	// before the pause, are kept; the rest is dropped
+	total := 40
+	for i := 0; i < total; i++ {
+		ch <- memberEvent(serf.EventMemberJoin, "a")
+	}
+	waitFor(t, func() bool {
+		return len(rec.events()) >= total-conf.PauseQueueSize-1
+	})
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, total-len(rec.events()) <= conf.PauseQueueSize+1)
+	assert.Empty(t, handler.recorded())
+
+	s.Resume()
+	waitFor(t, func() bool {
+		return len(handler.recorded())+len(rec.events()) == total
+	})
+	assert.Nil(t, s.Stop())
+}
@@ -0,0 +1,28 @@
+package serfer
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// source is a named event channel attached to a Serfer.
+type source struct {
+	name    string
+	channel <-chan serf.Event
+	handler EventHandler
+}
+
+// context returns the handler context for an envelope.
+func (e envelope) context(parent context.Context) context.Context {
+	ctx := withReceived(parent, e.received)
+	if e.source != nil {
+		ctx = withSource(ctx, e.source.name)
+	}
+	if e.replayed {
+		ctx = withReplayed(ctx)
+	}
+	if e.origin != nil {
+		ctx = withOrigin(ctx, e.origin.event)
+	}
+	return ctx
+}
@@ -0,0 +1,63 @@
+package serfer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSerfer_Sources(t *testing.T) {
+	lanHandler := &contextHandler{make(chan context.Context, 1)}
+	wanHandler := &contextHandler{make(chan context.Context, 1)}
+	lan := make(chan serf.Event, 1)
+	wan := make(chan serf.Event, 1)
+
+	s := NewSerfer(nil, lanHandler, 2)
+	assert.Nil(t, s.AddSource("lan", lan, nil))
+	assert.Nil(t, s.AddSource("wan", wan, wanHandler))
+	assert.Equal(t, ErrDuplicateSource, s.AddSource("wan", wan, nil))
+	s.Start()
+	assert.Equal(t, ErrStarted, s.AddSource("other", make(chan serf.Event), nil))
+
+	lan <- memberEvent(serf.EventMemberJoin, "a")
+	wan <- memberEvent(serf.EventMemberJoin, "a.dc1")
+
+	for handler, name := range map[*contextHandler]string{lanHandler: "lan", wanHandler: "wan"} {
+		select {
+		case ctx := <-handler.contexts:
+			source, ok := SourceFromContext(ctx)
+			assert.True(t, ok)
+			assert.Equal(t, name, source)
+		case <-time.After(time.Second):
+			t.Fatalf("Event from %s was not processed", name)
+		}
+	}
+
+	// The Serfer keeps running until every source is closed
+	close(lan)
+	wan <- memberEvent(serf.EventMemberFailed, "a.dc1")
+	select {
+	case <-wanHandler.contexts:
+	case <-time.After(time.Second):
+		t.Fatal("Event from wan was not processed")
+	}
+
+	close(wan)
+	assert.Equal(t, ErrSourceClosed, s.Wait())
+}
+
+func TestSerfer_DefaultSource(t *testing.T) {
+	handler := &contextHandler{make(chan context.Context, 1)}
+	ch := make(chan serf.Event, 1)
+	s := NewSerfer(ch, handler, 1)
+	assert.Equal(t, ErrDuplicateSource, s.AddSource(DefaultSource, ch, nil))
+	s.Start()
+
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	source, _ := SourceFromContext(<-handler.contexts)
+	assert.Equal(t, DefaultSource, source)
+	assert.Nil(t, s.Stop())
+}
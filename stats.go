@@ -0,0 +1,177 @@
+package serfer
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// latencySamples is the number of recent handler latencies kept to compute
+// percentiles.
+const latencySamples = 1024
+
+// eventTypes are the event types always reported by Stats.
+var eventTypes = []serf.EventType{
+	serf.EventMemberJoin,
+	serf.EventMemberLeave,
+	serf.EventMemberFailed,
+	serf.EventMemberUpdate,
+	serf.EventMemberReap,
+	serf.EventUser,
+	serf.EventQuery,
+}
+
+// stats collects the counters reported by Serfer.Stats.
+type stats struct {
+	mu        sync.Mutex
+	events    map[string]uint64
+	handlers  map[HandlerKind]uint64
+	errors    uint64
+	panics    uint64
+	restarts  uint64
+	last      time.Time
+	latencies []time.Duration
+	next      int
+}
+
+func newStats() *stats {
+	return &stats{
+		events:    make(map[string]uint64),
+		handlers:  make(map[HandlerKind]uint64),
+		latencies: make([]time.Duration, 0, latencySamples),
+	}
+}
+
+// received counts an event read from a source.
+func (s *stats) received(e serf.Event, t time.Time) {
+	s.mu.Lock()
+	s.events[eventTypeName(e)]++
+	s.last = t
+	s.mu.Unlock()
+}
+
+// handled records the outcome and duration of handling an event.
+func (s *stats) handled(d time.Duration, err error, perr *PanicError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.errors++
+	}
+	if perr != nil {
+		s.panics++
+	}
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, d)
+	} else {
+		s.latencies[s.next] = d
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+// restarted counts a worker restarted after a panic.
+func (s *stats) restarted() {
+	s.mu.Lock()
+	s.restarts++
+	s.mu.Unlock()
+}
+
+// invoked counts a call to a handler of the given kind.
+func (s *stats) invoked(kind HandlerKind) {
+	s.mu.Lock()
+	s.handlers[kind]++
+	s.mu.Unlock()
+}
+
+// snapshot returns the counters in the same form as serf.Serf.Stats.
+func (s *stats) snapshot() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	toString := func(v uint64) string {
+		return strconv.FormatUint(v, 10)
+	}
+	out := map[string]string{
+		"errors":          toString(s.errors),
+		"panics":          toString(s.panics),
+		"worker_restarts": toString(s.restarts),
+	}
+
+	for _, t := range eventTypes {
+		out["events_"+statKey(t.String())] = "0"
+	}
+	for name, n := range s.events {
+		out["events_"+statKey(name)] = toString(n)
+	}
+	for kind, n := range s.handlers {
+		out["handler_"+statKey(string(kind))] = toString(n)
+	}
+
+	if s.last.IsZero() {
+		out["last_event"] = "never"
+	} else {
+		out["last_event"] = s.last.Format(time.RFC3339Nano)
+	}
+
+	sorted := make([]time.Duration, len(s.latencies))
+	copy(sorted, s.latencies)
+	sort.Sort(durations(sorted))
+	out["latency_p50"] = percentile(sorted, 0.5).String()
+	out["latency_p90"] = percentile(sorted, 0.9).String()
+	out["latency_p99"] = percentile(sorted, 0.99).String()
+	return out
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// statKey converts a name to the style of serf's stat keys.
+func statKey(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// eventTypeName returns the name of an event's type. Unlike
+// serf.EventType.String it does not panic on unknown types.
+func eventTypeName(e serf.Event) string {
+	t := e.EventType()
+	for _, known := range eventTypes {
+		if t == known {
+			return t.String()
+		}
+	}
+	return "unknown"
+}
+
+// durations sorts time.Durations in increasing order.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// withStats returns a context through which handlers report their calls.
+func withStats(ctx context.Context, s *stats) context.Context {
+	return context.WithValue(ctx, statsKey, s)
+}
+
+// invoked counts a handler call in the stats carried by ctx, if any.
+func invoked(ctx context.Context, kind HandlerKind) {
+	if s, ok := ctx.Value(statsKey).(*stats); ok {
+		s.invoked(kind)
+	}
+}
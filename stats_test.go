@@ -0,0 +1,80 @@
+package serfer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// panickingUser panics on user events named "bad".
+type panickingUser struct{}
+
+func (panickingUser) HandleUserEvent(e serf.UserEvent) {
+	if e.Name == "bad" {
+		panic("bad event")
+	}
+}
+
+func TestSerfer_Stats(t *testing.T) {
+	handler := SerfEventHandler{
+		ServicePrefix: "svc",
+		IsLeaderEvent: func(string) bool { return false },
+		NodeJoined:    failingJoin{errors.New("unavailable")},
+		UserEvent:     panickingUser{},
+		Logger:        &log.NullLogger{},
+	}
+	conf := DefaultConfig()
+	conf.Logger = &log.NullLogger{}
+	ch := make(chan serf.Event, 4)
+	s := NewSerferConfig(ch, handler, conf)
+
+	stats := s.Stats()
+	assert.Equal(t, "never", stats["last_event"])
+	assert.Equal(t, "0", stats["events_member_join"])
+	assert.Equal(t, "0s", stats["latency_p50"])
+
+	ch <- memberEvent(serf.EventMemberJoin, "a")
+	ch <- memberEvent(serf.EventMemberJoin, "b")
+	ch <- userEvent("svc:bad", 1, false)
+	ch <- userEvent("svc:ok", 2, false)
+	close(ch)
+	s.Start()
+	assert.Equal(t, ErrSourceClosed, s.Wait())
+
+	stats = s.Stats()
+	assert.Equal(t, "0", stats["queue_depth"])
+	assert.Equal(t, "false", stats["paused"])
+	assert.Equal(t, "1", stats["workers"])
+	assert.Equal(t, "2", stats["events_member_join"])
+	assert.Equal(t, "2", stats["events_user"])
+	assert.Equal(t, "0", stats["events_query"])
+	assert.Equal(t, "2", stats["handler_member_join"])
+	assert.Equal(t, "2", stats["handler_user"])
+	assert.Equal(t, "2", stats["errors"])
+	assert.Equal(t, "1", stats["panics"])
+
+	last, err := time.Parse(time.RFC3339Nano, stats["last_event"])
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), last, time.Second)
+	for _, key := range []string{"latency_p50", "latency_p90", "latency_p99"} {
+		_, err := time.ParseDuration(stats[key])
+		assert.Nil(t, err, key)
+	}
+}
+
+func TestStats_Percentiles(t *testing.T) {
+	s := newStats()
+	for i := 1; i <= latencySamples+100; i++ {
+		s.handled(time.Duration(i)*time.Millisecond, nil, nil)
+	}
+
+	// Only the most recent samples are kept
+	stats := s.snapshot()
+	assert.Equal(t, "612ms", stats["latency_p50"])
+	assert.Equal(t, "1.022s", stats["latency_p90"])
+	assert.Equal(t, "1.114s", stats["latency_p99"])
+}
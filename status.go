@@ -0,0 +1,162 @@
+package serfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// Transition is a change of the status of a member.
+type Transition struct {
+
+	// Member is the member whose status changed.
+	Member serf.Member
+
+	// Previous is the last known status of the member. It is serf.StatusNone
+	// for members which had not been seen before.
+	Previous serf.MemberStatus
+
+	// Current is the new status of the member. It is StatusReap when the
+	// member was reaped.
+	Current serf.MemberStatus
+
+	// Elapsed is the time the member spent in the previous status. It is zero
+	// for members which had not been seen before.
+	Elapsed time.Duration
+
+	// Time is when the transition was observed.
+	Time time.Time
+}
+
+// Recovered returns true if a failed member is alive again.
+func (t Transition) Recovered() bool {
+	return t.Previous == serf.StatusFailed && t.Current == serf.StatusAlive
+}
+
+// Rejoined returns true if a member which left is alive again.
+func (t Transition) Rejoined() bool {
+	return t.Previous == serf.StatusLeft && t.Current == serf.StatusAlive
+}
+
+// TransitionHandler handles member status transitions.
+type TransitionHandler interface {
+	HandleTransition(Transition)
+}
+
+// TransitionErrHandler handles member status transitions and reports failure.
+type TransitionErrHandler interface {
+	HandleTransitionErr(context.Context, Transition) error
+}
+
+// memberStatus is the last known status of a member.
+type memberStatus struct {
+	status serf.MemberStatus
+	since  time.Time
+}
+
+// StatusTracker keeps the last known status of every member so that member
+// events can be reported as transitions. It is safe for concurrent use.
+type StatusTracker struct {
+	mu      sync.Mutex
+	members map[string]memberStatus
+	now     func() time.Time
+}
+
+// NewStatusTracker returns a StatusTracker which has not seen any member.
+func NewStatusTracker() *StatusTracker {
+	return &StatusTracker{members: make(map[string]memberStatus), now: time.Now}
+}
+
+// Status returns the last known status of a member.
+func (t *StatusTracker) Status(name string) (serf.MemberStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.members[name]
+	return m.status, ok
+}
+
+// Observe records the statuses of the members of an event and returns the
+// transitions it caused. Members whose status did not change, such as
+// updated members which were already alive, are not reported. Reaped
+// members are forgotten.
+func (t *StatusTracker) Observe(e serf.MemberEvent) []Transition {
+	var status serf.MemberStatus
+	switch e.Type {
+	case serf.EventMemberJoin, serf.EventMemberUpdate:
+		status = serf.StatusAlive
+	case serf.EventMemberLeave:
+		status = serf.StatusLeft
+	case serf.EventMemberFailed:
+		status = serf.StatusFailed
+	case serf.EventMemberReap:
+		status = StatusReap
+	default:
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var transitions []Transition
+	for _, m := range e.Members {
+		prev, seen := t.members[m.Name]
+		if seen && prev.status == status {
+			continue
+		}
+
+		tr := Transition{Member: m, Previous: serf.StatusNone, Current: status, Time: now}
+		if seen {
+			tr.Previous = prev.status
+			tr.Elapsed = now.Sub(prev.since)
+		}
+		transitions = append(transitions, tr)
+
+		if status == StatusReap {
+			delete(t.members, m.Name)
+		} else {
+			t.members[m.Name] = memberStatus{status, now}
+		}
+	}
+	return transitions
+}
+
+// transitions calls the transition handlers for each transition. Recovered
+// and rejoined members are reported to NodeRecovered and NodeRejoined after
+// NodeTransitioned.
+func (s *SerfEventHandler) transitions(ctx context.Context, e serf.MemberEvent, transitions []Transition) error {
+	var err error
+	call := func(kind HandlerKind, h TransitionHandler, tr Transition) {
+		terr := s.try(ctx, kind, serf.MemberEvent{Type: e.Type, Members: []serf.Member{tr.Member}}, func(ctx context.Context) error {
+			return handleTransition(ctx, h, tr)
+		})
+		if err == nil {
+			err = terr
+		}
+	}
+
+	for _, tr := range transitions {
+		if s.NodeTransitioned != nil {
+			call(KindTransition, s.NodeTransitioned, tr)
+		}
+		if tr.Recovered() && s.NodeRecovered != nil {
+			call(KindRecovered, s.NodeRecovered, tr)
+		}
+		if tr.Rejoined() && s.NodeRejoined != nil {
+			call(KindRejoined, s.NodeRejoined, tr)
+		}
+	}
+	return err
+}
+
+// handleTransition calls the error variant of a TransitionHandler if it implements it.
+func handleTransition(ctx context.Context, h TransitionHandler, tr Transition) error {
+	if c, ok := h.(TransitionErrHandler); ok {
+		return c.HandleTransitionErr(ctx, tr)
+	}
+	h.HandleTransition(tr)
+	return nil
+}
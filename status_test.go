@@ -0,0 +1,106 @@
+package serfer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// transitionRecorder records the transitions it handles, labelled by handler.
+type transitionRecorder struct {
+	label       string
+	transitions *[]string
+}
+
+func (r transitionRecorder) HandleTransition(t Transition) {
+	*r.transitions = append(*r.transitions, fmt.Sprintf("%s %s %v->%v after %v",
+		r.label, t.Member.Name, t.Previous, t.Current, t.Elapsed))
+}
+
+// testStatusTracker returns a StatusTracker whose clock advances a minute
+// every time it is read.
+func testStatusTracker() *StatusTracker {
+	t := NewStatusTracker()
+	now := time.Unix(0, 0)
+	t.now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	return t
+}
+
+func TestStatusTracker_Observe(t *testing.T) {
+	tracker := testStatusTracker()
+
+	trs := tracker.Observe(memberEvent(serf.EventMemberJoin, "a", "b"))
+	if assert.Len(t, trs, 2) {
+		assert.Equal(t, serf.StatusNone, trs[0].Previous)
+		assert.Equal(t, serf.StatusAlive, trs[0].Current)
+		assert.Equal(t, time.Duration(0), trs[0].Elapsed)
+		assert.False(t, trs[0].Recovered())
+	}
+
+	assert.Len(t, tracker.Observe(memberEvent(serf.EventMemberUpdate, "a")), 0, "a was already alive")
+
+	trs = tracker.Observe(memberEvent(serf.EventMemberFailed, "a"))
+	if assert.Len(t, trs, 1) {
+		assert.Equal(t, serf.StatusAlive, trs[0].Previous)
+		assert.Equal(t, serf.StatusFailed, trs[0].Current)
+		assert.Equal(t, 2*time.Minute, trs[0].Elapsed)
+	}
+
+	trs = tracker.Observe(memberEvent(serf.EventMemberJoin, "a"))
+	if assert.Len(t, trs, 1) {
+		assert.True(t, trs[0].Recovered())
+		assert.Equal(t, time.Minute, trs[0].Elapsed)
+	}
+
+	tracker.Observe(memberEvent(serf.EventMemberLeave, "b"))
+	trs = tracker.Observe(memberEvent(serf.EventMemberReap, "b"))
+	if assert.Len(t, trs, 1) {
+		assert.Equal(t, StatusReap, trs[0].Current)
+	}
+	_, ok := tracker.Status("b")
+	assert.False(t, ok, "reaped members are forgotten")
+	status, _ := tracker.Status("a")
+	assert.Equal(t, serf.StatusAlive, status)
+}
+
+func TestSerfEventHandler_Transitions(t *testing.T) {
+	var transitions []string
+	var joined []string
+	h := SerfEventHandler{
+		Statuses:         testStatusTracker(),
+		NodeJoined:       joinNames{&joined},
+		NodeTransitioned: transitionRecorder{"transition", &transitions},
+		NodeRecovered:    transitionRecorder{"recovered", &transitions},
+		NodeRejoined:     transitionRecorder{"rejoined", &transitions},
+		Logger:           &log.NullLogger{},
+	}
+
+	for _, e := range []serf.MemberEvent{
+		memberEvent(serf.EventMemberJoin, "a", "b"),
+		memberEvent(serf.EventMemberFailed, "a"),
+		memberEvent(serf.EventMemberLeave, "b"),
+		memberEvent(serf.EventMemberJoin, "a", "b"),
+	} {
+		assert.Nil(t, h.HandleEventErr(context.Background(), e))
+	}
+
+	assert.Equal(t, []string{"a,b", "a,b"}, joined, "joins are still reported")
+	assert.Equal(t, []string{
+		"transition a none->alive after 0s",
+		"transition b none->alive after 0s",
+		"transition a alive->failed after 1m0s",
+		"transition b alive->left after 2m0s",
+		"transition a failed->alive after 2m0s",
+		"recovered a failed->alive after 2m0s",
+		"transition b left->alive after 1m0s",
+		"rejoined b left->alive after 1m0s",
+	}, transitions)
+}
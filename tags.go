@@ -0,0 +1,211 @@
+package serfer
+
+import (
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// TagChange is the old and new value of a changed tag.
+type TagChange struct {
+	Old string
+	New string
+}
+
+// TagDiff describes how the tags of a member changed.
+type TagDiff struct {
+
+	// Member is the member with its new tags.
+	Member serf.Member
+
+	// Added are the tags the member did not have before.
+	Added map[string]string
+
+	// Removed are the tags the member no longer has, with their old values.
+	Removed map[string]string
+
+	// Changed are the tags whose value changed.
+	Changed map[string]TagChange
+}
+
+// Empty returns true if no tag changed.
+func (d TagDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Has returns true if the tag was added, removed or changed.
+func (d TagDiff) Has(key string) bool {
+	_, added := d.Added[key]
+	_, removed := d.Removed[key]
+	_, changed := d.Changed[key]
+	return added || removed || changed
+}
+
+// Change returns the old and new value of a tag. Missing tags have empty
+// values. It returns false if the tag did not change.
+func (d TagDiff) Change(key string) (TagChange, bool) {
+	if v, ok := d.Added[key]; ok {
+		return TagChange{New: v}, true
+	}
+	if v, ok := d.Removed[key]; ok {
+		return TagChange{Old: v}, true
+	}
+	c, ok := d.Changed[key]
+	return c, ok
+}
+
+// diffTags returns the difference between two tag sets.
+func diffTags(m serf.Member, old map[string]string) TagDiff {
+	d := TagDiff{
+		Member:  m,
+		Added:   make(map[string]string),
+		Removed: make(map[string]string),
+		Changed: make(map[string]TagChange),
+	}
+	for k, v := range m.Tags {
+		if o, ok := old[k]; !ok {
+			d.Added[k] = v
+		} else if o != v {
+			d.Changed[k] = TagChange{o, v}
+		}
+	}
+	for k, o := range old {
+		if _, ok := m.Tags[k]; !ok {
+			d.Removed[k] = o
+		}
+	}
+	return d
+}
+
+// TagHandler handles changes to the tags of members.
+type TagHandler interface {
+	HandleTagDiff(TagDiff)
+}
+
+// TagErrHandler handles changes to the tags of members and reports failure.
+type TagErrHandler interface {
+	HandleTagDiffErr(context.Context, TagDiff) error
+}
+
+// tagHandler is a TagHandler and the tag it is interested in.
+type tagHandler struct {
+	key     string
+	handler TagHandler
+}
+
+// TagTracker keeps the last known tags of every member so that changes can
+// be reported as a TagDiff. Tags are compared when a member is updated or
+// joins again after leaving or failing; the tags of members seen for the
+// first time are recorded without being reported. Reaped members are
+// forgotten. It is safe for concurrent use.
+type TagTracker struct {
+	mu       sync.Mutex
+	tags     map[string]map[string]string
+	handlers []tagHandler
+}
+
+// NewTagTracker returns a TagTracker without handlers which has not seen any
+// member.
+func NewTagTracker() *TagTracker {
+	return &TagTracker{tags: make(map[string]map[string]string)}
+}
+
+// Handle registers a handler which is called for every change.
+func (t *TagTracker) Handle(h TagHandler) {
+	t.HandleKey("", h)
+}
+
+// HandleKey registers a handler which is only called when the given tag is
+// added, removed or changed. The handler receives the whole diff.
+func (t *TagTracker) HandleKey(key string, h TagHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.handlers = append(t.handlers, tagHandler{key, h})
+}
+
+// Tags returns a copy of the last known tags of a member.
+func (t *TagTracker) Tags(name string) (map[string]string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tags, ok := t.tags[name]
+	if !ok {
+		return nil, false
+	}
+	return copyTags(tags), true
+}
+
+// Observe records the tags of the members of an event and returns the
+// changes since they were last seen.
+func (t *TagTracker) Observe(e serf.MemberEvent) []TagDiff {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var diffs []TagDiff
+	for _, m := range e.Members {
+		switch e.Type {
+		case serf.EventMemberJoin, serf.EventMemberUpdate:
+			if old, ok := t.tags[m.Name]; ok {
+				if d := diffTags(m, old); !d.Empty() {
+					diffs = append(diffs, d)
+				}
+			}
+			t.tags[m.Name] = copyTags(m.Tags)
+		case serf.EventMemberReap:
+			delete(t.tags, m.Name)
+		}
+	}
+	return diffs
+}
+
+// handlersFor returns the handlers interested in a diff.
+func (t *TagTracker) handlersFor(d TagDiff) []TagHandler {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var handlers []TagHandler
+	for _, h := range t.handlers {
+		if h.key == "" || d.Has(h.key) {
+			handlers = append(handlers, h.handler)
+		}
+	}
+	return handlers
+}
+
+// copyTags returns a copy of a tag set.
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+// tagDiffs calls the handlers of the Tags tracker for each diff.
+func (s *SerfEventHandler) tagDiffs(ctx context.Context, e serf.MemberEvent, diffs []TagDiff) error {
+	var err error
+	for _, d := range diffs {
+		d := d
+		for _, h := range s.Tags.handlersFor(d) {
+			h := h
+			terr := s.try(ctx, KindTags, serf.MemberEvent{Type: e.Type, Members: []serf.Member{d.Member}}, func(ctx context.Context) error {
+				return handleTagDiff(ctx, h, d)
+			})
+			if err == nil {
+				err = terr
+			}
+		}
+	}
+	return err
+}
+
+// handleTagDiff calls the error variant of a TagHandler if it implements it.
+func handleTagDiff(ctx context.Context, h TagHandler, d TagDiff) error {
+	if c, ok := h.(TagErrHandler); ok {
+		return c.HandleTagDiffErr(ctx, d)
+	}
+	h.HandleTagDiff(d)
+	return nil
+}
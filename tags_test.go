@@ -0,0 +1,84 @@
+package serfer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// diffRecorder records the tag diffs it handles.
+type diffRecorder struct {
+	diffs []TagDiff
+	err   error
+}
+
+func (r *diffRecorder) HandleTagDiff(d TagDiff) {
+	r.diffs = append(r.diffs, d)
+}
+
+func (r *diffRecorder) HandleTagDiffErr(ctx context.Context, d TagDiff) error {
+	r.HandleTagDiff(d)
+	return r.err
+}
+
+func tagEvent(t serf.EventType, name string, tags map[string]string) serf.MemberEvent {
+	return serf.MemberEvent{Type: t, Members: []serf.Member{tagged(name, tags)}}
+}
+
+func TestTagTracker_Observe(t *testing.T) {
+	tracker := NewTagTracker()
+
+	assert.Len(t, tracker.Observe(tagEvent(serf.EventMemberJoin, "a", map[string]string{"role": "web", "version": "1", "dc": "east"})), 0,
+		"the tags of new members are not reported")
+	assert.Len(t, tracker.Observe(tagEvent(serf.EventMemberUpdate, "a", map[string]string{"role": "web", "version": "1", "dc": "east"})), 0)
+
+	diffs := tracker.Observe(tagEvent(serf.EventMemberUpdate, "a", map[string]string{"role": "web", "version": "2", "upgrading": "true"}))
+	if assert.Len(t, diffs, 1) {
+		d := diffs[0]
+		assert.Equal(t, map[string]string{"upgrading": "true"}, d.Added)
+		assert.Equal(t, map[string]string{"dc": "east"}, d.Removed)
+		assert.Equal(t, map[string]TagChange{"version": {"1", "2"}}, d.Changed)
+		assert.True(t, d.Has("dc"))
+		assert.False(t, d.Has("role"))
+
+		c, ok := d.Change("dc")
+		assert.True(t, ok)
+		assert.Equal(t, TagChange{Old: "east"}, c)
+		_, ok = d.Change("role")
+		assert.False(t, ok)
+	}
+
+	tracker.Observe(tagEvent(serf.EventMemberFailed, "a", nil))
+	diffs = tracker.Observe(tagEvent(serf.EventMemberJoin, "a", map[string]string{"role": "web", "version": "3", "upgrading": "true"}))
+	if assert.Len(t, diffs, 1, "rejoining members are compared with their old tags") {
+		assert.Equal(t, map[string]TagChange{"version": {"2", "3"}}, diffs[0].Changed)
+	}
+
+	tracker.Observe(tagEvent(serf.EventMemberReap, "a", nil))
+	_, ok := tracker.Tags("a")
+	assert.False(t, ok)
+}
+
+func TestSerfEventHandler_TagDiffs(t *testing.T) {
+	all := &diffRecorder{}
+	version := &diffRecorder{err: errors.New("rollout failed")}
+	tracker := NewTagTracker()
+	tracker.Handle(all)
+	tracker.HandleKey("version", version)
+
+	h := SerfEventHandler{Tags: tracker, Logger: &log.NullLogger{}}
+	assert.Nil(t, h.HandleEventErr(context.Background(), tagEvent(serf.EventMemberJoin, "a", map[string]string{"version": "1", "state": "ready"})))
+	assert.Nil(t, h.HandleEventErr(context.Background(), tagEvent(serf.EventMemberUpdate, "a", map[string]string{"version": "1", "state": "draining"})))
+	err := h.HandleEventErr(context.Background(), tagEvent(serf.EventMemberUpdate, "a", map[string]string{"version": "2", "state": "draining"}))
+	assert.EqualError(t, err, "rollout failed")
+
+	assert.Len(t, all.diffs, 2)
+	if assert.Len(t, version.diffs, 1) {
+		c, _ := version.diffs[0].Change("version")
+		assert.Equal(t, TagChange{"1", "2"}, c)
+	}
+}